@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/audit"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	"github.com/git-lfs/git-lfs/v3/tools/humanize"
+)
+
+const verifyAuditOperation = "verify-audit"
+
+// defaultAuditLogMaxSize is the size after which the audit log is rotated.
+const defaultAuditLogMaxSize = 100 * humanize.Megabyte
+
+// auditSink records the requests of a session to the audit log.
+type auditSink struct {
+	log        *audit.Log
+	identity   string
+	repository string
+}
+
+var _ transfer.EventSink = &auditSink{}
+
+// Record implements transfer.EventSink. Failing to write a record is
+// reported on stderr, not only traced, as the request has been served.
+func (s *auditSink) Record(e transfer.Event) error {
+	if err := s.log.Append(newEventRecord(e, s.identity, s.repository)); err != nil {
+		fmt.Fprintf(os.Stderr, "git-lfs-transfer: error writing audit log: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// auditLog returns the audit log configured for the repository, or nil if
+// there is none. Its path and the path of its key are relative to the Git
+// directory.
+func (r *repository) auditLog() (*audit.Log, error) {
+	path := r.config.String("auditlog", "")
+	if path == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(r.gitdir, path)
+	}
+	maxSize, err := r.config.Size("auditlogmaxsize", defaultAuditLogMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	var keep int
+	if v := r.config.String("auditlogkeep", ""); v != "" {
+		keep, err = strconv.Atoi(v)
+		if err != nil || keep < 0 {
+			return nil, fmt.Errorf("invalid number of files for %s.auditlogkeep: %q", configSection, v)
+		}
+	}
+	var key []byte
+	if keyFile := r.config.String("auditlogkeyfile", ""); keyFile != "" {
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(r.gitdir, keyFile)
+		}
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading audit log key: %w", err)
+		}
+		if key = bytes.TrimSpace(b); len(key) == 0 {
+			return nil, fmt.Errorf("audit log key %s is empty", keyFile)
+		}
+	}
+	return audit.New(path, maxSize, keep, key), nil
+}
+
+// auditSink returns the sink recording the repository's sessions to its audit
+// log, or nil if it has none.
+func (r *repository) auditSink() (transfer.EventSink, error) {
+	log, err := r.auditLog()
+	if err != nil || log == nil {
+		return nil, err
+	}
+	identity, err := r.identity()
+	if err != nil {
+		return nil, err
+	}
+	return &auditSink{log: log, identity: identity, repository: r.commonDir}, nil
+}
+
+// verifyAudit checks the chain of hashes of the repository's audit log.
+func verifyAudit(w io.Writer, repo *repository, args ...string) error {
+	if len(args) != 0 {
+		return usageErrorf("%s: unexpected arguments: %v", verifyAuditOperation, args)
+	}
+	log, err := repo.auditLog()
+	if err != nil {
+		return err
+	}
+	if log == nil {
+		return fmt.Errorf("%s: no audit log configured", verifyAuditOperation)
+	}
+	n, err := log.Verify()
+	if err != nil {
+		return fmt.Errorf("%w: audit log tampered with after %d entries: %w", errProblemsFound, n, err)
+	}
+	fmt.Fprintf(w, "verified %d entries\n", n)
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/lfsgit"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+const checkLocksOperation = "check-locks"
+
+// checkLocks rejects a push that modifies paths locked by someone other than
+// the pusher. It is meant to run from the pre-receive hook and reads the ref
+// updates from r. The pusher is the user running the hook, the same user
+// that owns the locks created over SSH.
+func checkLocks(r io.Reader, w io.Writer, repo *repository, args ...string) error {
+	if len(args) != 0 {
+		return usageErrorf("%s takes no arguments", checkLocksOperation)
+	}
+	updates, err := readRefUpdates(r)
+	if err != nil {
+		return err
+	}
+	gr, err := repo.git()
+	if err != nil {
+		return err
+	}
+	walker, tips, err := repo.pushWalker(gr)
+	if err != nil {
+		return err
+	}
+	commits, _, err := walker.Incoming(pushedCommits(updates), tips)
+	if err != nil {
+		return err
+	}
+	changed := map[string]struct{}{}
+	for _, c := range commits {
+		paths, err := lfsgit.ChangedPaths(c)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			changed[p] = struct{}{}
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	user, err := repo.identity()
+	if err != nil {
+		return err
+	}
+	backend, err := repo.backend()
+	if err != nil {
+		return err
+	}
+	rules, err := repo.lockRules()
+	if err != nil {
+		return err
+	}
+	locks := backend.LockBackend(transfer.Args{})
+	var violations, unlocked []string
+	for p := range changed {
+		lock, err := locks.FromPath(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			if rules == nil {
+				continue
+			}
+			if rule := rules.requiresLock(p); rule != nil {
+				unlocked = append(unlocked, fmt.Sprintf("%s (rule %q)", p, rule.pattern))
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading lock for %q: %w", p, err)
+		}
+		if lock.OwnerName() == user {
+			continue
+		}
+		violations = append(violations, fmt.Sprintf("%s (locked by %s since %s)",
+			p, lock.OwnerName(), lock.FormattedTimestamp()))
+	}
+	if len(violations) == 0 && len(unlocked) == 0 {
+		return nil
+	}
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		fmt.Fprintln(w, "git-lfs-transfer: push rejected, paths locked by other users:")
+		for _, v := range violations {
+			fmt.Fprintf(w, "  %s\n", v)
+		}
+		fmt.Fprintln(w, "Ask the lock owners to push or unlock them, then push again.")
+	}
+	if len(unlocked) > 0 {
+		sort.Strings(unlocked)
+		fmt.Fprintln(w, "git-lfs-transfer: push rejected, paths that must be locked before being changed:")
+		for _, u := range unlocked {
+			fmt.Fprintf(w, "  %s\n", u)
+		}
+		fmt.Fprintln(w, "Lock them with `git lfs lock`, then push again.")
+	}
+	return errPushRejected
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/lfsgit"
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const checkPushOperation = "check-push"
+
+// errPushRejected is returned by hook operations that reject a push. The
+// reasons have already been written out for the pusher.
+var errPushRejected = errors.New("push rejected")
+
+// refUpdate is a ref update received by a pre-receive hook.
+type refUpdate struct {
+	Old  plumbing.Hash
+	New  plumbing.Hash
+	Name string
+}
+
+// readRefUpdates reads ref updates in the format pre-receive hooks receive
+// them on standard input: "<old> <new> <ref>" lines.
+func readRefUpdates(r io.Reader) ([]refUpdate, error) {
+	var updates []refUpdate
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid ref update: %q", line)
+		}
+		updates = append(updates, refUpdate{
+			Old:  plumbing.NewHash(fields[0]),
+			New:  plumbing.NewHash(fields[1]),
+			Name: fields[2],
+		})
+	}
+	return updates, s.Err()
+}
+
+// pushedCommits returns the new values of the ref updates that aren't
+// deletions.
+func pushedCommits(updates []refUpdate) []plumbing.Hash {
+	var hashes []plumbing.Hash
+	for _, u := range updates {
+		if !u.New.IsZero() {
+			hashes = append(hashes, u.New)
+		}
+	}
+	return hashes
+}
+
+// pushWalker returns a walker over the objects of the repository, including
+// those of the push being received, and the commits the repository's refs
+// point to, which a push is compared against.
+func (r *repository) pushWalker(gr *gogit.Repository) (*lfsgit.Walker, []plumbing.Hash, error) {
+	tips, err := lfsgit.RefHashes(gr.Storer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lfsgit.NewWalker(lfsgit.IncomingObjects(gr.Storer, r.commonDir)), tips, nil
+}
+
+// checkPush rejects a push that introduces Git LFS pointers to objects that
+// haven't been uploaded. It is meant to run from the pre-receive hook and
+// reads the ref updates from r.
+func checkPush(r io.Reader, w io.Writer, repo *repository, args ...string) error {
+	if len(args) != 0 {
+		return usageErrorf("%s takes no arguments", checkPushOperation)
+	}
+	updates, err := readRefUpdates(r)
+	if err != nil {
+		return err
+	}
+	gr, err := repo.git()
+	if err != nil {
+		return err
+	}
+	walker, tips, err := repo.pushWalker(gr)
+	if err != nil {
+		return err
+	}
+	pointers := map[string]transfer.Pointer{}
+	paths := map[string][]string{}
+	err = walker.PointersSince(pushedCommits(updates), tips, func(e lfsgit.Entry) error {
+		pointers[e.Oid] = e.Pointer
+		paths[e.Oid] = append(paths[e.Oid], e.Path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(pointers) == 0 {
+		return nil
+	}
+	oids := make([]string, 0, len(pointers))
+	for oid := range pointers {
+		oids = append(oids, oid)
+	}
+	sort.Strings(oids)
+	// The objects may have been uploaded in any session.
+	backend, err := repo.backend(local.WithAllQuarantines())
+	if err != nil {
+		return err
+	}
+	stater, ok := backend.(transfer.ObjectStater)
+	if !ok {
+		return fmt.Errorf("%s isn't supported by the configured backend", checkPushOperation)
+	}
+	var missing []string
+	for _, oid := range oids {
+		size, err := stater.StatObject(oid)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, transfer.ErrCorruptData) {
+			return err
+		}
+		if err == nil && size == pointers[oid].Size {
+			continue
+		}
+		for _, p := range paths[oid] {
+			missing = append(missing, fmt.Sprintf("%s (%s)", p, oid))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	fmt.Fprintln(w, "git-lfs-transfer: push rejected, missing Git LFS objects:")
+	for _, m := range missing {
+		fmt.Fprintf(w, "  %s\n", m)
+	}
+	fmt.Fprintln(w, "Upload them with `git lfs push --all` and push again.")
+	return errPushRejected
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+	"github.com/git-lfs/git-lfs/v3/tools/humanize"
+)
+
+const cleanupOperation = "cleanup"
+
+// defaultStaleTempAge is how long a temporary upload file must have been left
+// untouched before it's removed.
+const defaultStaleTempAge = 24 * time.Hour
+
+// cleanup removes the temporary files left behind by killed processes.
+func cleanup(w io.Writer, repo *repository, args ...string) error {
+	age, err := repo.config.Duration("staletempage", defaultStaleTempAge)
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet(cleanupOperation, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	flags.DurationVar(&age, "age", age, "minimum age of removed temporary upload files")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if flags.NArg() != 0 {
+		return usageErrorf("%s: unexpected arguments: %v", cleanupOperation, flags.Args())
+	}
+	lb, err := repo.localBackend()
+	if err != nil {
+		return err
+	}
+	verb, summary := "removed", "removed %d files, reclaimed %s\n"
+	if *dryRun {
+		verb, summary = "would remove", "would remove %d files, reclaiming %s\n"
+	}
+	var count, total int64
+	err = lb.Cleanup(local.CleanupOptions{Age: age, DryRun: *dryRun}, func(path string, size int64) error {
+		count++
+		total += size
+		_, err := fmt.Fprintf(w, "%s %s %d\n", verb, path, size)
+		return err
+	})
+	fmt.Fprintf(w, summary, count, humanize.FormatBytes(uint64(total)))
+	return err
+}
+
+// cleanupStale removes the temporary files left behind by killed processes
+// when a session starts. Errors are only logged, they don't prevent serving
+// the session.
+func cleanupStale(repo *repository) {
+	enabled, err := repo.config.Bool("cleanuponstartup", true)
+	if err != nil || !enabled {
+		return
+	}
+	age, err := repo.config.Duration("staletempage", defaultStaleTempAge)
+	if err != nil {
+		return
+	}
+	lb, err := repo.localBackend()
+	if err != nil {
+		return
+	}
+	err = lb.Cleanup(local.CleanupOptions{Age: age}, func(string, int64) error { return nil })
+	if err != nil {
+		logger.Log("error cleaning up temporary files", "err", err)
+	}
+}
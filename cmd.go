@@ -1,15 +1,21 @@
 package main
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/charmbracelet/git-lfs-transfer/internal/dedup"
 	"github.com/charmbracelet/git-lfs-transfer/internal/local"
 	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/filesystem"
 	"github.com/rubyist/tracerx"
 )
 
@@ -24,26 +30,302 @@ func ensureDirs(path string) error {
 	return nil
 }
 
+// repository is the repository git-lfs-transfer operates on.
+type repository struct {
+	gitdir    string
+	commonDir string
+	lfsPath   string
+	umask     os.FileMode
+	config    *config
+	now       time.Time
+}
+
+// openRepository opens the repository at path and makes sure its LFS
+// directories exist.
+func openRepository(path string) (*repository, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	gitdir, commonDir, err := discoverGitDir(path)
+	if err != nil {
+		return nil, err
+	}
+	config := loadConfig(gitdir)
+	lfsPath := filepath.Join(commonDir, "lfs")
+	if storage := config.Git("lfs.storage"); storage != "" {
+		lfsPath = storage
+		if !filepath.IsAbs(lfsPath) {
+			lfsPath = filepath.Join(commonDir, lfsPath)
+		}
+	}
+	logger.Log("repository", "gitdir", gitdir, "lfs", lfsPath)
+	if err := ensureDirs(lfsPath); err != nil {
+		return nil, err
+	}
+	umask := setPermissions(config.Git("core.sharedRepository"))
+	logger.Log("umask", "umask", umask)
+	return &repository{
+		gitdir:    gitdir,
+		commonDir: commonDir,
+		lfsPath:   lfsPath,
+		umask:     umask,
+		config:    config,
+		now:       time.Now(),
+	}, nil
+}
+
+// git opens the repository with go-git.
+func (r *repository) git() (*gogit.Repository, error) {
+	return gogit.PlainOpen(r.commonDir)
+}
+
+// discoverGitDir returns the git directory of the repository at path, and
+// the common directory shared by all its worktrees. GIT_DIR takes precedence,
+// like it does for git, and `.git` files are followed.
+func discoverGitDir(path string) (string, string, error) {
+	gitdir := os.Getenv("GIT_DIR")
+	if gitdir != "" {
+		if !filepath.IsAbs(gitdir) {
+			gitdir = filepath.Join(path, gitdir)
+		}
+	} else {
+		repo, err := gogit.PlainOpen(path)
+		if err != nil {
+			return "", "", fmt.Errorf("error opening repository %q: %w", path, err)
+		}
+		st, ok := repo.Storer.(*filesystem.Storage)
+		if !ok {
+			return "", "", fmt.Errorf("unsupported repository storage for %q", path)
+		}
+		gitdir = st.Filesystem().Root()
+	}
+	gitdir, err := filepath.Abs(gitdir)
+	if err != nil {
+		return "", "", err
+	}
+	commonDir := os.Getenv("GIT_COMMON_DIR")
+	if commonDir == "" {
+		b, err := os.ReadFile(filepath.Join(gitdir, "commondir"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", "", err
+		}
+		commonDir = strings.TrimSpace(string(b))
+	}
+	switch {
+	case commonDir == "":
+		commonDir = gitdir
+	case !filepath.IsAbs(commonDir):
+		commonDir = filepath.Join(gitdir, commonDir)
+	}
+	return gitdir, filepath.Clean(commonDir), nil
+}
+
+// localBackend creates the local backend configured for the repository, with
+// the given extra options.
+func (r *repository) localBackend(extra ...local.Option) (*local.LocalBackend, error) {
+	opts, err := backendOptions(r.config)
+	if err != nil {
+		return nil, err
+	}
+	if r.config.String("identityenv", "") != "" {
+		identity, err := r.identity()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, local.WithLockOwner(identity))
+	}
+	scanners, err := r.scanners()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, local.WithScanners(scanners...))
+	opts = append(opts, extra...)
+	return local.New(r.lfsPath, r.umask, &r.now, opts...), nil
+}
+
+// uploadQuarantine returns the local backend options quarantining the uploads
+// of a new session, if `lfstransfer.quarantineUploads` is set.
+func (r *repository) uploadQuarantine() ([]local.Option, error) {
+	quarantine, err := r.config.Bool("quarantineuploads", false)
+	if err != nil || !quarantine {
+		return nil, err
+	}
+	session := make([]byte, 8)
+	if _, err := rand.Read(session); err != nil {
+		return nil, err
+	}
+	return []local.Option{local.WithUploadQuarantine(fmt.Sprintf("%s-%x", r.now.UTC().Format("20060102T150405"), session))}, nil
+}
+
+// backend creates the storage backend configured for the repository, with
+// the given extra options for the local backend.
+func (r *repository) backend(extra ...local.Option) (transfer.Backend, error) {
+	lb, err := r.localBackend(extra...)
+	if err != nil {
+		return nil, err
+	}
+	switch kind := r.config.String("backend", "local"); kind {
+	case "local":
+		return lb, nil
+	case "dedup":
+		if err := checkDedupConfig(r.config); err != nil {
+			return nil, err
+		}
+		return dedup.New(r.lfsPath, lb), nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", kind)
+	}
+}
+
+// errProblemsFound is returned by check operations that found problems, as
+// opposed to failing to run. The problems have already been written out.
+var errProblemsFound = errors.New("check failed")
+
+// usageError is an error in the command line arguments, for which the usage
+// is printed.
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string { return e.err.Error() }
+
+func (e usageError) Unwrap() error { return e.err }
+
+// usageErrorf returns a usageError formatted according to format.
+func usageErrorf(format string, a ...any) error {
+	return usageError{fmt.Errorf(format, a...)}
+}
+
+// isUsageError reports whether err is an error in the command line arguments.
+func isUsageError(err error) bool {
+	var ue usageError
+	return errors.As(err, &ue)
+}
+
 // Run runs the git-lfs-transfer command against the given I/O and arguments.
 func Run(r io.Reader, w io.Writer, args ...string) error {
-	if len(args) != 2 {
-		return fmt.Errorf("expected 2 arguments, got %d", len(args))
+	if len(args) < 2 {
+		return usageErrorf("expected 2 arguments, got %d", len(args))
 	}
 	path := args[0]
 	op := args[1]
-	_, err := os.Stat(path)
+	repo, err := openRepository(path)
 	if err != nil {
 		return err
 	}
-	gitdir := path
-	if !strings.HasSuffix(path, ".git") {
-		gitdir = filepath.Join(path, ".git")
+	switch op {
+	case transfer.UploadOperation, transfer.DownloadOperation:
+		if len(args) != 2 {
+			return usageErrorf("expected 2 arguments, got %d", len(args))
+		}
+		var extra []local.Option
+		if op == transfer.UploadOperation {
+			if extra, err = repo.uploadQuarantine(); err != nil {
+				return err
+			}
+		}
+		backend, err := repo.backend(extra...)
+		if err != nil {
+			return err
+		}
+		opts, err := repo.processorOptions(op)
+		if err != nil {
+			return err
+		}
+		cleanupStale(repo)
+		return serve(r, w, backend, op, opts...)
+	case statsOperation:
+		return stats(w, repo, args[2:]...)
+	case migrateLayoutOperation:
+		return migrateLayout(w, repo, args[2:]...)
+	case gcOperation:
+		return gc(w, repo, args[2:]...)
+	case fsckOperation:
+		return fsck(w, repo, args[2:]...)
+	case cleanupOperation:
+		return cleanup(w, repo, args[2:]...)
+	case scrubOperation:
+		return scrub(w, repo, args[2:]...)
+	case usageOperation:
+		return usage(w, repo, args[2:]...)
+	case verifyAuditOperation:
+		return verifyAudit(w, repo, args[2:]...)
+	case promoteOperation:
+		return promote(r, w, repo, args[2:]...)
+	case pruneQuarantineOperation:
+		return pruneQuarantine(w, repo, args[2:]...)
+	case checkPushOperation:
+		return checkPush(r, w, repo, args[2:]...)
+	case checkLocksOperation:
+		return checkLocks(r, w, repo, args[2:]...)
+	default:
+		return usageErrorf("unknown operation %q", op)
 	}
-	lfsPath := filepath.Join(gitdir, "lfs")
-	if err := ensureDirs(lfsPath); err != nil {
-		return err
+}
+
+// processorOptions returns the transfer processor options configured for the
+// repository's sessions of the given operation.
+func (r *repository) processorOptions(op string) ([]transfer.ProcessorOption, error) {
+	var opts []transfer.ProcessorOption
+	enforce, err := r.config.Bool("enforcelockable", false)
+	if err != nil {
+		return nil, err
+	}
+	if enforce {
+		gr, err := r.git()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, transfer.WithLockPolicy(newLockablePolicy(gr)))
+	}
+	rules, err := r.lockRules()
+	if err != nil {
+		return nil, err
+	}
+	if rules != nil {
+		opts = append(opts, transfer.WithLockPolicy(rules))
+	}
+	verify, err := r.config.Bool("verifydownloads", false)
+	if err != nil {
+		return nil, err
+	}
+	if verify {
+		opts = append(opts, transfer.WithDownloadVerification())
+	}
+	limiters, err := r.rateLimiters(op)
+	if err != nil {
+		return nil, err
+	}
+	if len(limiters) > 0 {
+		opts = append(opts, transfer.WithRateLimit(limiters...))
+	}
+	requests, err := r.requestLimiter()
+	if err != nil {
+		return nil, err
+	}
+	if requests != nil {
+		opts = append(opts, transfer.WithRequestLimit(requests))
 	}
-	umask := setPermissions(gitdir)
+	hooks, err := r.hooks()
+	if err != nil {
+		return nil, err
+	}
+	if hooks != nil {
+		opts = append(opts, transfer.WithUploadPolicy(hooks), transfer.WithEventSink(hooks))
+	}
+	sink, err := r.auditSink()
+	if err != nil {
+		return nil, err
+	}
+	if sink != nil {
+		opts = append(opts, transfer.WithEventSink(sink))
+	}
+	return opts, nil
+}
+
+// serve processes transfer protocol commands for the given operation.
+func serve(r io.Reader, w io.Writer, backend transfer.Backend, op string, opts ...transfer.ProcessorOption) error {
 	handler := transfer.NewPktline(r, w, logger)
 	for _, cap := range transfer.Capabilities {
 		if err := handler.WritePacketText(cap); err != nil {
@@ -53,18 +335,13 @@ func Run(r io.Reader, w io.Writer, args ...string) error {
 	if err := handler.WriteFlush(); err != nil {
 		logger.Log("error flushing capabilities", "err", err)
 	}
-	now := time.Now()
-	logger.Log("umask", "umask", umask)
-	backend := local.New(lfsPath, umask, &now)
-	p := transfer.NewProcessor(handler, backend, logger)
+	p := transfer.NewProcessor(handler, backend, logger, opts...)
 	defer logger.Log("done processing commands")
 	switch op {
-	case "upload":
+	case transfer.UploadOperation:
 		return p.ProcessCommands(transfer.UploadOperation)
-	case "download":
-		return p.ProcessCommands(transfer.DownloadOperation)
 	default:
-		return fmt.Errorf("unknown operation %q", op)
+		return p.ProcessCommands(transfer.DownloadOperation)
 	}
 }
 
@@ -73,7 +350,34 @@ func Usage() string {
 	return `Git LFS SSH transfer agent
 
 Usage:
-  git-lfs-transfer PATH OPERATION
+  git-lfs-transfer PATH OPERATION [ARGS...]
+
+Operations:
+  upload      serve an upload session
+  download    serve a download session
+  stats       print deduplication statistics (dedup backend only)
+  migrate-layout [--finish] LAYOUT
+              move objects to another on-disk layout
+  gc [--dry-run] [--grace=DURATION]
+              prune objects no ref points to anymore; don't run it on a
+              repository listed in another one's alternates, whose objects
+              it would prune too
+  fsck [--quarantine] [--remove-torn] [--stale=DURATION]
+              verify stored objects and report problems as JSON lines
+  scrub [--rate=SIZE] [--max-time=DURATION] [--restart]
+              verify stored objects in the background, repairing them from
+              replicas
+  cleanup [--dry-run] [--age=DURATION]
+              remove temporary files left behind by killed processes
+  usage [--recount]
+              print the storage used by the repository and its quotas
+  verify-audit
+              check that the audit log wasn't tampered with
+  check-push  pre-receive hook rejecting pushes with missing objects
+  check-locks pre-receive hook rejecting pushes to paths locked by others
+  promote     post-receive hook moving the pushed objects out of quarantine
+  prune-quarantine [--expire=DURATION]
+              remove upload quarantines of pushes that never happened
 `
 }
 
@@ -99,9 +403,13 @@ func Command(stdin io.Reader, stdout io.Writer, stderr io.Writer, args ...string
 		logger.Log("signal received", "signal", s)
 	case err := <-errc:
 		logger.Log("done running")
-		fmt.Fprintln(stderr, Usage())
-		fmt.Fprintln(stderr, err)
 		if err != nil {
+			if isUsageError(err) {
+				fmt.Fprintln(stderr, Usage())
+			}
+			if !errors.Is(err, errPushRejected) {
+				fmt.Fprintln(stderr, err)
+			}
 			return err
 		}
 	}
@@ -7,8 +7,14 @@ import (
 	"os"
 )
 
-func setPermissions(path string) os.FileMode {
+func setPermissions(string) os.FileMode {
 	return 0077
 }
 
 func setup(c chan os.Signal) {}
+
+// isExecutable reports whether a file may be run. Permissions don't tell on
+// these platforms, so every file is.
+func isExecutable(os.FileInfo) bool {
+	return true
+}
@@ -1,19 +1,32 @@
 package main_test
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	lfstransfer "github.com/charmbracelet/git-lfs-transfer"
+	"github.com/charmbracelet/git-lfs-transfer/internal/flock"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -430,3 +443,1938 @@ func TestSimpleLocking(t *testing.T) {
 
 	assert.Equal(t, replaceUserId(expected), out.String())
 }
+
+// pktText encodes s as a newline-terminated text pkt-line.
+func pktText(s string) string {
+	return fmt.Sprintf("%04x%s\n", len(s)+5, s)
+}
+
+// pktData encodes data as binary pkt-lines.
+func pktData(data string) string {
+	var b strings.Builder
+	for len(data) > 0 {
+		n := min(len(data), 65516)
+		fmt.Fprintf(&b, "%04x%s", n+4, data[:n])
+		data = data[n:]
+	}
+	return b.String()
+}
+
+// testContent is the content of the object most tests upload.
+const testContent = "This is\x00a complicated\xc2\xa9message.\n"
+
+// oidOf returns the object ID of content.
+func oidOf(content string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+}
+
+// putObject encodes a put-object request uploading content.
+func putObject(content string) string {
+	return pktText("put-object "+oidOf(content)) + pktText(fmt.Sprintf("size=%d", len(content))) + "0001" + pktData(content) + "0000"
+}
+
+// batchOf encodes a batch request for the objects with the given contents.
+func batchOf(contents ...string) string {
+	var b strings.Builder
+	b.WriteString(pktText("batch") + "0001")
+	for _, content := range contents {
+		b.WriteString(pktText(fmt.Sprintf("%s %d", oidOf(content), len(content))))
+	}
+	b.WriteString("0000")
+	return b.String()
+}
+
+// objectFile returns the path of the object oid stored in the repository at
+// path with the default layout.
+func objectFile(path, oid string) string {
+	return filepath.Join(path, "lfs", "objects", oid[0:2], oid[2:4], oid)
+}
+
+func setConfig(tb testing.TB, r *git.Repository, kv ...string) {
+	tb.Helper()
+	cfg, err := r.Config()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		section, key, _ := strings.Cut(kv[i], ".")
+		cfg.Raw.Section(section).SetOption(key, kv[i+1])
+	}
+	if err := r.SetConfig(cfg); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestCompressedUpload(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.compression", "zstd", "lfstransfer.compressionminsize", "0")
+	content := strings.Repeat("This is a compressible message.\n", 256)
+	oid := oidOf(content)
+	size := fmt.Sprintf("size=%d", len(content))
+	msg := pktText("version 1") + "0000" +
+		pktText("put-object "+oid) + pktText(size) + "0001" + pktData(content) + "0000" +
+		pktText("verify-object "+oid) + pktText(size) + "0000"
+	expected := pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + "0000" +
+		pktText("status 200") + "0000"
+
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+
+	stored := filepath.Join(path, "lfs", "objects", oid[0:2], oid[2:4], oid+".zst")
+	info, err := os.Stat(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Less(t, info.Size(), int64(len(content)))
+
+	msg = pktText("version 1") + "0000" +
+		pktText("batch") + pktText("transfer=ssh") + "0001" + pktText(oid+" "+strconv.Itoa(len(content))) + "0000" +
+		pktText("get-object "+oid) + "0000"
+	expected = pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + "0001" + pktText(oid+" "+strconv.Itoa(len(content))+" download") + "0000" +
+		pktText("status 200") + pktText(size) + "0001" + pktData(content) + "0000"
+
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+}
+
+func TestDedupUpload(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.backend", "dedup")
+	rnd := rand.New(rand.NewSource(1))
+	base := make([]byte, 512<<10)
+	rnd.Read(base)
+	first := string(base)
+	second := string(base[:len(base)-10]) + "0123456789"
+
+	var msg strings.Builder
+	msg.WriteString(pktText("version 1") + "0000")
+	for _, content := range []string{first, second} {
+		msg.WriteString(putObject(content))
+	}
+	expected := pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + "0000" +
+		pktText("status 200") + "0000"
+
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg.String()), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "stats"); err != nil {
+		t.Fatal(err)
+	}
+	stats := out.String()
+	assert.Contains(t, stats, "objects 2\n")
+	assert.Contains(t, stats, fmt.Sprintf("logical-size %d\n", 2*len(base)))
+	assert.NotContains(t, stats, "ratio 1.00\n")
+
+	oid := oidOf(second)
+	in := pktText("version 1") + "0000" + pktText("get-object "+oid) + "0000"
+	expected = pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + pktText(fmt.Sprintf("size=%d", len(second))) + "0001" + pktData(second) + "0000"
+
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+
+	// A failed upload leaves no chunks behind.
+	countChunks := func() int {
+		var n int
+		filepath.WalkDir(filepath.Join(path, "lfs", "chunks"), func(_ string, d os.DirEntry, _ error) error {
+			if d != nil && d.Type().IsRegular() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+	chunks := countChunks()
+	third := make([]byte, 256<<10)
+	rnd.Read(third)
+	in = pktText("version 1") + "0000" +
+		pktText("put-object "+oidOf("bogus")) + pktText(fmt.Sprintf("size=%d", len(third))) + "0001" + pktData(string(third)) + "0000"
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), pktText("status 400"))
+	assert.Equal(t, chunks, countChunks())
+	entries, err := os.ReadDir(filepath.Join(path, "lfs", "incomplete"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, entries)
+
+	// gc prunes the objects no ref points to, and then their chunks.
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "gc", "--grace=0s"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), "pruned "+oid+" ")
+	assert.Contains(t, out.String(), "pruned chunk ")
+	assert.Contains(t, out.String(), "pruned 2 objects, reclaimed ")
+	assert.Zero(t, countChunks())
+
+	// Settings the backend doesn't honor are refused.
+	setConfig(t, r, "lfstransfer.quota", "1GB")
+	err = lfstransfer.Run(strings.NewReader(in), &out, path, "upload")
+	assert.ErrorContains(t, err, "lfstransfer.quota is not supported by the dedup backend")
+}
+
+func TestAlternates(t *testing.T) {
+	_, upstream := newTestRepo(t)
+	_, fork := newTestRepo(t)
+	content := testContent
+	oid := oidOf(content)
+	size := fmt.Sprintf("size=%d", len(content))
+	msg := pktText("version 1") + "0000" + putObject(content)
+
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, upstream, "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	info := filepath.Join(fork, "lfs", "objects", "info")
+	if err := os.MkdirAll(info, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	alternates := "# upstream\n" + filepath.Join(upstream, "lfs", "objects") + "\n"
+	if err := os.WriteFile(filepath.Join(info, "alternates"), []byte(alternates), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	msg = pktText("version 1") + "0000" +
+		pktText("verify-object "+oid) + pktText(size) + "0000" +
+		pktText("get-object "+oid) + "0000"
+	expected := pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + "0000" +
+		pktText("status 200") + pktText(size) + "0001" + pktData(content) + "0000"
+
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, fork, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+}
+
+func TestMigrateLayout(t *testing.T) {
+	r, path := newTestRepo(t)
+	content := testContent
+	oid := oidOf(content)
+	size := fmt.Sprintf("size=%d", len(content))
+	msg := pktText("version 1") + "0000" + putObject(content)
+
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "migrate-layout", "gitlab"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), "moved 1 objects from the default layout to the gitlab layout\n")
+	if _, err := os.Stat(filepath.Join(path, "lfs", "objects", oid[0:2], oid[2:4], oid[4:])); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "migrate-layout", "--finish", "gitlab"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), "migration finished\n")
+
+	msg = pktText("version 1") + "0000" + pktText("get-object "+oid) + "0000"
+	expected := pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + pktText(size) + "0001" + pktData(content) + "0000"
+
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+
+	// Sessions started before the migration still use the old layout, and
+	// find the objects it moved.
+	setConfig(t, r, "lfstransfer.layout", "default")
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+}
+
+func TestMigrateLayoutConflict(t *testing.T) {
+	_, path := newTestRepo(t)
+	oid := oidOf(testContent)
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(pktText("version 1")+"0000"+putObject(testContent)), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	old := filepath.Join(path, "lfs", "objects", oid[0:2], oid[2:4], oid)
+	dest := filepath.Join(path, "lfs", "objects", oid[0:2], oid[2:4], oid[4:])
+	if err := os.WriteFile(dest, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The object isn't removed in favour of a copy with other content.
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "migrate-layout", "gitlab"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), "kept "+old+": object "+oid+" differs from the copy in the gitlab layout\n")
+	assert.Contains(t, out.String(), "moved 0 objects")
+	assert.FileExists(t, old)
+	out.Reset()
+	err := lfstransfer.Run(nil, &out, path, "migrate-layout", "--finish", "gitlab")
+	assert.ErrorContains(t, err, "kept 1 conflicting objects")
+
+	// Identical copies are fine.
+	if err := os.Remove(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dest, []byte(testContent), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "migrate-layout", "--finish", "gitlab"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), "moved 1 objects")
+	assert.Contains(t, out.String(), "migration finished\n")
+	assert.NoFileExists(t, old)
+}
+
+func TestMigrateLayoutQuarantine(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.quarantineuploads", "true")
+	oid := oidOf(testContent)
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(pktText("version 1")+"0000"+putObject(testContent)), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Quarantined objects are migrated too, so they can still be promoted
+	// once the old layout is dropped.
+	for _, args := range [][]string{{"gitlab"}, {"--finish", "gitlab"}} {
+		out.Reset()
+		if err := lfstransfer.Run(nil, &out, append([]string{path, "migrate-layout"}, args...)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head := commitFiles(t, r, plumbing.ZeroHash, map[string]string{"a.bin": pointer(testContent)})
+	if err := r.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", head)); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	updates := fmt.Sprintf("%s %s refs/heads/main\n", plumbing.ZeroHash, head)
+	if err := lfstransfer.Run(strings.NewReader(updates), &out, path, "promote"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "git-lfs-transfer: promoted 1 objects\n", out.String())
+	assert.FileExists(t, filepath.Join(path, "lfs", "objects", oid[0:2], oid[2:4], oid[4:]))
+}
+
+func TestInvalidOid(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.layout", "flat")
+	msg := pktText("version 1") + "0000" +
+		pktText("batch") + "0001" + pktText("../../config 10") + "0000" +
+		pktText("get-object ../../config") + "0000" +
+		pktText("put-object ../../hooks/pre-receive") + pktText("size=6") + "0001" + pktData("exit 0") + "0000" +
+		pktText("verify-object ../../config") + pktText("size=10") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, strings.Count(out.String(), pktText("status 400")), out.String())
+	assert.NotContains(t, out.String(), "repositoryformatversion")
+	assert.Contains(t, out.String(), `invalid object ID "../../config"`)
+	assert.NoFileExists(t, filepath.Join(path, "hooks", "pre-receive"))
+}
+
+func TestGitFileAndStorage(t *testing.T) {
+	dir := t.TempDir()
+	worktree := filepath.Join(dir, "worktree")
+	gitdir := filepath.Join(dir, "repo.git")
+	r, err := git.PlainInit(gitdir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, r, "lfs.storage", "custom-lfs")
+	if err := os.MkdirAll(worktree, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(worktree, ".git"), []byte("gitdir: ../repo.git\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	oid := oidOf(testContent)
+	msg := pktText("version 1") + "0000" + putObject(testContent)
+
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, worktree, "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	bts, err := os.ReadFile(filepath.Join(gitdir, "custom-lfs", "objects", oid[0:2], oid[2:4], oid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, testContent, string(bts))
+}
+
+func TestRelativeGitDir(t *testing.T) {
+	dir := t.TempDir()
+	r, err := git.PlainInit(filepath.Join(dir, "repo.git"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, r, "lfs.storage", "custom-lfs")
+	t.Chdir(dir)
+	t.Setenv("GIT_DIR", "repo.git")
+
+	oid := oidOf(testContent)
+	msg := pktText("version 1") + "0000" + putObject(testContent)
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, ".", "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.FileExists(t, filepath.Join(dir, "repo.git", "custom-lfs", "objects", oid[0:2], oid[2:4], oid))
+	// The environment of other child processes is left alone.
+	assert.Equal(t, "repo.git", os.Getenv("GIT_DIR"))
+}
+
+// pointer returns the Git LFS pointer file for content.
+func pointer(content string) string {
+	return fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%x\nsize %d\n", sha256.Sum256([]byte(content)), len(content))
+}
+
+// commitFiles commits the given top-level files on top of parent, which may
+// be the zero hash, and returns the new commit.
+func commitFiles(tb testing.TB, r *git.Repository, parent plumbing.Hash, files map[string]string) plumbing.Hash {
+	tb.Helper()
+	return commitFilesAt(tb, r, parent, time.Unix(0, 0), files)
+}
+
+func commitFilesAt(tb testing.TB, r *git.Repository, parent plumbing.Hash, when time.Time, files map[string]string) plumbing.Hash {
+	tb.Helper()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tree := &object.Tree{}
+	for _, name := range names {
+		blob := r.Storer.NewEncodedObject()
+		blob.SetType(plumbing.BlobObject)
+		w, err := blob.Writer()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := w.Write([]byte(files[name])); err != nil {
+			tb.Fatal(err)
+		}
+		w.Close() // nolint: errcheck
+		h, err := r.Storer.SetEncodedObject(blob)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: h})
+	}
+	treeObj := r.Storer.NewEncodedObject()
+	if err := tree.Encode(treeObj); err != nil {
+		tb.Fatal(err)
+	}
+	treeHash, err := r.Storer.SetEncodedObject(treeObj)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: when}
+	commit := &object.Commit{Author: sig, Committer: sig, Message: "test\n", TreeHash: treeHash}
+	if !parent.IsZero() {
+		commit.ParentHashes = []plumbing.Hash{parent}
+	}
+	commitObj := r.Storer.NewEncodedObject()
+	if err := commit.Encode(commitObj); err != nil {
+		tb.Fatal(err)
+	}
+	h, err := r.Storer.SetEncodedObject(commitObj)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return h
+}
+
+func TestGC(t *testing.T) {
+	r, path := newTestRepo(t)
+	kept := testContent
+	pruned := "abc123"
+	var msg strings.Builder
+	msg.WriteString(pktText("version 1") + "0000")
+	for _, content := range []string{kept, pruned} {
+		msg.WriteString(putObject(content))
+	}
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg.String()), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	first := commitFiles(t, r, plumbing.ZeroHash, map[string]string{"a.bin": pointer(pruned)})
+	second := commitFiles(t, r, first, map[string]string{"a.bin": pointer(kept)})
+	if err := r.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", second)); err != nil {
+		t.Fatal(err)
+	}
+	prunedOid := oidOf(pruned)
+	prunedPath := objectFile(path, prunedOid)
+
+	// Older history still references the object.
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "gc", "--grace=0s"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "pruned 0 objects, reclaimed 0 B\n", out.String())
+
+	if err := r.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", commitFiles(t, r, plumbing.ZeroHash, map[string]string{"a.bin": pointer(kept)}))); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "gc", "--dry-run", "--grace=0s"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "would prune "+prunedOid+" 6\nwould prune 1 objects, reclaiming 6 B\n", out.String())
+	if _, err := os.Stat(prunedPath); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "gc", "--grace=0s"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "pruned "+prunedOid+" 6\npruned 1 objects, reclaimed 6 B\n", out.String())
+	if _, err := os.Stat(prunedPath); !os.IsNotExist(err) {
+		t.Errorf("file should not exist %s", prunedPath)
+	}
+}
+
+func TestGCMissingCommit(t *testing.T) {
+	r, path := newTestRepo(t)
+	kept := testContent
+	old := "abc123"
+	msg := pktText("version 1") + "0000" + putObject(kept) + putObject(old)
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	first := commitFiles(t, r, plumbing.ZeroHash, map[string]string{"a.bin": pointer(old)})
+	second := commitFiles(t, r, first, map[string]string{"a.bin": pointer(kept)})
+	if err := r.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", second)); err != nil {
+		t.Fatal(err)
+	}
+	hex := first.String()
+	if err := os.Remove(filepath.Join(path, "objects", hex[:2], hex[2:])); err != nil {
+		t.Fatal(err)
+	}
+
+	// Objects only reachable through a missing commit aren't pruned.
+	out.Reset()
+	err := lfstransfer.Run(nil, &out, path, "gc", "--grace=0s")
+	assert.ErrorContains(t, err, "error reading commit "+hex)
+	assert.FileExists(t, objectFile(path, oidOf(old)))
+
+	// Unless the repository is shallow.
+	if err := os.WriteFile(filepath.Join(path, "shallow"), []byte(second.String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "gc", "--grace=0s"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), "pruned 1 objects")
+	assert.NoFileExists(t, objectFile(path, oidOf(old)))
+}
+
+func TestFsck(t *testing.T) {
+	_, path := newTestRepo(t)
+	good := testContent
+	bad := "abc123"
+	var msg strings.Builder
+	msg.WriteString(pktText("version 1") + "0000")
+	for _, content := range []string{good, bad} {
+		msg.WriteString(putObject(content))
+	}
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg.String()), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	badOid := oidOf(bad)
+	badPath := objectFile(path, badOid)
+	if err := os.WriteFile(badPath, []byte("abc124"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Objects stored with any layout they can be found with are in place.
+	goodOid := oidOf(good)
+	goodPath := filepath.Join(path, "lfs", "objects", goodOid[0:2], goodOid[2:4], goodOid[4:])
+	if err := os.Rename(objectFile(path, goodOid), goodPath); err != nil {
+		t.Fatal(err)
+	}
+	misplaced := filepath.Join(path, "lfs", "objects", "stray")
+	if err := os.WriteFile(misplaced, []byte("stray"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	temp := filepath.Join(path, "lfs", "incomplete", "leftover")
+	if err := os.WriteFile(temp, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(temp, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	err := lfstransfer.Run(nil, &out, path, "fsck", "--quarantine")
+	assert.ErrorContains(t, err, "found 3 problems")
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	kinds := map[string]map[string]interface{}{}
+	for _, rec := range records {
+		kinds[rec["type"].(string)] = rec
+	}
+	assert.Len(t, records, 4)
+	assert.Equal(t, badOid, kinds["corrupt"]["oid"])
+	assert.Equal(t, misplaced, kinds["misplaced"]["path"])
+	assert.Equal(t, temp, kinds["stale-temp"]["path"])
+	assert.Equal(t, float64(3), kinds["summary"]["checked"])
+	if _, err := os.Stat(badPath); !os.IsNotExist(err) {
+		t.Errorf("file should have been quarantined %s", badPath)
+	}
+	if _, err := os.Stat(kinds["corrupt"]["quarantined"].(string)); err != nil {
+		t.Error(err)
+	}
+	assert.FileExists(t, goodPath)
+
+	// The usage is only printed for errors in the arguments.
+	var stderr bytes.Buffer
+	err = lfstransfer.Command(nil, io.Discard, &stderr, path, "fsck")
+	assert.ErrorContains(t, err, "found 1 problems")
+	assert.NotContains(t, stderr.String(), lfstransfer.Usage())
+	stderr.Reset()
+	err = lfstransfer.Command(nil, io.Discard, &stderr, path, "fsck", "extra")
+	assert.ErrorContains(t, err, "unexpected arguments")
+	assert.Contains(t, stderr.String(), lfstransfer.Usage())
+}
+
+func TestCheckPush(t *testing.T) {
+	r, path := newTestRepo(t)
+	uploaded := testContent
+	missing := "abc123"
+	msg := pktText("version 1") + "0000" + putObject(uploaded)
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	first := commitFiles(t, r, plumbing.ZeroHash, map[string]string{"a.bin": pointer(uploaded)})
+	updates := fmt.Sprintf("%s %s refs/heads/main\n", plumbing.ZeroHash, first)
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(updates), &out, path, "check-push"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, out.String())
+	if err := r.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", first)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A repository without room for the missing objects still lists them.
+	setConfig(t, r, "lfstransfer.quota", strconv.Itoa(len(uploaded)), "lfstransfer.maxobjectsize", "1")
+	second := commitFiles(t, r, first, map[string]string{"a.bin": pointer(uploaded), "b.bin": pointer(missing)})
+	updates = fmt.Sprintf("%s %s refs/heads/main\n", first, second)
+	out.Reset()
+	err := lfstransfer.Run(strings.NewReader(updates), &out, path, "check-push")
+	assert.ErrorContains(t, err, "push rejected")
+	assert.Equal(t, "git-lfs-transfer: push rejected, missing Git LFS objects:\n"+
+		"  b.bin ("+oidOf(missing)+")\n"+
+		"Upload them with `git lfs push --all` and push again.\n", out.String())
+}
+
+func TestCheckPushSkewedDates(t *testing.T) {
+	r, path := newTestRepo(t)
+	files := map[string]string{"a.bin": pointer("never uploaded")}
+	at := func(parent plumbing.Hash, secs int64) plumbing.Hash {
+		return commitFilesAt(t, r, parent, time.Unix(secs, 0), files)
+	}
+	// main was accepted before its object was required, and reaches the
+	// commits the new branch is based on through a commit dated before them.
+	base := at(plumbing.ZeroHash, 50)
+	fork := at(base, 100)
+	main := at(at(fork, 10), 200)
+	if err := r.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", main)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the commits the push adds are checked.
+	topic := at(fork, 300)
+	updates := fmt.Sprintf("%s %s refs/heads/topic\n", plumbing.ZeroHash, topic)
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(updates), &out, path, "check-push"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, out.String())
+}
+
+func TestCheckLocks(t *testing.T) {
+	r, path := newTestRepo(t)
+	msg := pktText("version 1") + "0000" +
+		pktText("lock") + pktText("path=a.bin") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	first := commitFiles(t, r, plumbing.ZeroHash, map[string]string{"a.bin": pointer("a"), "b.bin": pointer("b")})
+	updates := fmt.Sprintf("%s %s refs/heads/main\n", plumbing.ZeroHash, first)
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(updates), &out, path, "check-locks"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, out.String())
+	if err := r.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", first)); err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOOS == "windows" || os.Getuid() != 0 {
+		t.Skip("handing a lock over to another user requires root")
+	}
+	other, err := user.LookupId("65534")
+	if err != nil {
+		t.Skip("no user to hand the lock over to")
+	}
+	lockFile := filepath.Join(path, "lfs", "locks", fmt.Sprintf("%x", sha256.Sum256([]byte("v1:a.bin"))))
+	if err := os.Lchown(lockFile, 65534, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	second := commitFiles(t, r, first, map[string]string{"a.bin": pointer("a"), "b.bin": pointer("c")})
+	updates = fmt.Sprintf("%s %s refs/heads/main\n", first, second)
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(updates), &out, path, "check-locks"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, out.String())
+
+	third := commitFiles(t, r, first, map[string]string{"a.bin": pointer("c"), "b.bin": pointer("b")})
+	updates = fmt.Sprintf("%s %s refs/heads/main\n", first, third)
+	out.Reset()
+	err = lfstransfer.Run(strings.NewReader(updates), &out, path, "check-locks")
+	assert.ErrorContains(t, err, "push rejected")
+	assert.Contains(t, out.String(), "git-lfs-transfer: push rejected, paths locked by other users:\n"+
+		"  a.bin (locked by "+other.Username+" since ")
+}
+
+func TestEnforceLockable(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.enforcelockable", "true")
+	head := commitFiles(t, r, plumbing.ZeroHash, map[string]string{
+		".gitattributes": "*.psd filter=lfs diff=lfs merge=lfs -text lockable\n",
+	})
+	if err := r.Storer.SetReference(plumbing.NewHashReference("refs/heads/master", head)); err != nil {
+		t.Fatal(err)
+	}
+	msg := pktText("version 1") + "0000" +
+		pktText("lock") + pktText("path=art/a.psd") + "0000" +
+		pktText("lock") + pktText("path=a.txt") + pktText("refname=refs/heads/topic") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), pktText("status 201"))
+	assert.Contains(t, out.String(), pktText("status 403")+"0001"+
+		pktText("error: forbidden: a.txt is not lockable, add the lockable attribute to it in .gitattributes")+"0000")
+}
+
+func TestLockPolicy(t *testing.T) {
+	r, path := newTestRepo(t)
+	policy := `[rule "*.psd"]
+	maxLocks = 1
+[rule "docs/*"]
+	locking = forbidden
+[rule "secret.bin"]
+	allow = someone-else
+[rule "*.req"]
+	locking = required
+`
+	if err := os.WriteFile(filepath.Join(path, "lfs-locks.conf"), []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, r, "lfstransfer.lockpolicy", "lfs-locks.conf")
+	// A lock being written and an unreadable lock don't get in the way of
+	// counting and listing locks.
+	locksDir := filepath.Join(path, "lfs", "locks")
+	if err := os.MkdirAll(locksDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		fmt.Sprintf("%x.lock", sha256.Sum256([]byte("v1:c.psd"))): "",
+		"garbage": "not a lock",
+	} {
+		if err := os.WriteFile(filepath.Join(locksDir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := pktText("version 1") + "0000" +
+		pktText("lock") + pktText("path=a.psd") + "0000" +
+		pktText("lock") + pktText("path=b.psd") + "0000" +
+		pktText("lock") + pktText("path=docs/x.txt") + "0000" +
+		pktText("lock") + pktText("path=secret.bin") + "0000" +
+		pktText("lock") + pktText("path=other.bin") + "0000" +
+		pktText("list-lock") + pktText("limit=100") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, strings.Count(out.String(), pktText("status 201")))
+	assert.Equal(t, 3, strings.Count(out.String(), pktText("status 403")))
+	assert.Contains(t, out.String(), pktText("status 200"))
+	assert.NotContains(t, out.String(), pktText("status 500"))
+	assert.Contains(t, out.String(), "already holds 1 locks, the maximum per rule \"*.psd\"\n")
+	assert.Contains(t, out.String(), pktText("error: forbidden: locking docs/x.txt is forbidden by rule \"docs/*\""))
+	assert.Contains(t, out.String(), "may not lock secret.bin per rule \"secret.bin\"\n")
+
+	head := commitFiles(t, r, plumbing.ZeroHash, map[string]string{"a.psd": pointer("a"), "b.req": pointer("b")})
+	updates := fmt.Sprintf("%s %s refs/heads/main\n", plumbing.ZeroHash, head)
+	out.Reset()
+	err := lfstransfer.Run(strings.NewReader(updates), &out, path, "check-locks")
+	assert.ErrorContains(t, err, "push rejected")
+	assert.Equal(t, "git-lfs-transfer: push rejected, paths that must be locked before being changed:\n"+
+		"  b.req (rule \"*.req\")\n"+
+		"Lock them with `git lfs lock`, then push again.\n", out.String())
+}
+
+func TestLockIdentity(t *testing.T) {
+	r, path := newTestRepo(t)
+	policy := `[rule "*.psd"]
+	maxLocks = 1
+[rule "secret.bin"]
+	allow = alice
+`
+	if err := os.WriteFile(filepath.Join(path, "lfs-locks.conf"), []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, r, "lfstransfer.lockpolicy", "lfs-locks.conf", "lfstransfer.identityenv", "TEST_LFS_IDENTITY")
+	lock := func(path string) string {
+		return pktText("lock") + pktText("path="+path) + "0000"
+	}
+	t.Setenv("TEST_LFS_IDENTITY", "alice")
+	msg := pktText("version 1") + "0000" + lock("a.psd") + lock("secret.bin")
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, strings.Count(out.String(), pktText("status 201")))
+	assert.Contains(t, out.String(), pktText("ownername=alice"))
+
+	// Locks are counted and allowed for the identity of the session, all
+	// sessions being served by the same system user.
+	t.Setenv("TEST_LFS_IDENTITY", "bob")
+	msg = pktText("version 1") + "0000" + lock("b.psd") + lock("secret.bin") +
+		pktText("list-lock") + pktText("limit=100") + "0000"
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, strings.Count(out.String(), pktText("status 201")))
+	assert.Contains(t, out.String(), pktText("ownername=bob"))
+	assert.Contains(t, out.String(), "bob may not lock secret.bin per rule \"secret.bin\"\n")
+	// Only bob's lock is ours.
+	assert.Equal(t, 1, strings.Count(out.String(), " ours\n"))
+	assert.Equal(t, 2, strings.Count(out.String(), " theirs\n"))
+	assert.Equal(t, 2, strings.Count(out.String(), " alice\n"))
+}
+
+func TestSharedPool(t *testing.T) {
+	pool := t.TempDir()
+	content := testContent
+	oid := oidOf(content)
+	msg := pktText("version 1") + "0000" + putObject(content)
+	poolPath := filepath.Join(pool, oid[0:2], oid[2:4], oid)
+	upload := func() string {
+		r, path := newTestRepo(t)
+		setConfig(t, r, "lfstransfer.sharedpool", pool)
+		var out bytes.Buffer
+		if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+			t.Fatal(err)
+		}
+		return objectFile(path, oid)
+	}
+	first := upload()
+	poolInfo, err := os.Stat(poolPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstInfo, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, os.SameFile(poolInfo, firstInfo))
+
+	// A bad pool copy doesn't replace a good upload, and is replaced by it.
+	if err := os.Remove(poolPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(poolPath, []byte(content[:10]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	second := upload()
+	b, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, content, string(b))
+	b, err = os.ReadFile(poolPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, content, string(b))
+
+	// Linking an old pool copy doesn't make the upload look old to gc.
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(poolPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	third, err := os.Stat(upload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	poolInfo, err = os.Stat(poolPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, os.SameFile(poolInfo, third))
+	assert.WithinDuration(t, time.Now(), third.ModTime(), time.Hour)
+}
+
+func TestQuota(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.quota", "40", "lfstransfer.maxobjectsize", "30")
+	small := strings.Repeat("a", 20)
+	medium := strings.Repeat("b", 25)
+	large := strings.Repeat("c", 35)
+	msg := pktText("version 1") + "0000" +
+		batchOf(large) +
+		batchOf(small) +
+		putObject(small) +
+		batchOf(medium) +
+		putObject(medium) +
+		batchOf(small)
+	expected := pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 413") + "0001" + pktText("error: too large: object "+oidOf(large)+" is 35 B, over the 30 B limit") + "0000" +
+		pktText("status 200") + "0001" + pktText(oidOf(small)+" 20 upload") + "0000" +
+		pktText("status 200") + "0000" +
+		pktText("status 413") + "0001" + pktText("error: too large: uploading 25 B would exceed the repository quota, 20 B of 40 B used") + "0000" +
+		pktText("status 413") + "0001" + pktText("error: too large: uploading 25 B would exceed the repository quota, 20 B of 40 B used") + "0000" +
+		pktText("status 200") + "0001" + pktText(oidOf(small)+" 20 noop") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "usage"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "used 20\nquota 40\nmax-object-size 30\n", out.String())
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("free space isn't checked on windows")
+	}
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.minfreespace", "1000PB")
+	content := strings.Repeat("a", 20)
+	oid := oidOf(content)
+	msg := pktText("version 1") + "0000" + batchOf(content) + putObject(content) + batchOf(content)
+	refused := pktText("status 507") + "0001" + pktText("error: insufficient storage: not enough space left to store 20 B") + "0000"
+	expected := pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		refused + refused + refused
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+
+	// A batch of objects already stored needs no space.
+	objPath := objectFile(path, oid)
+	if err := os.MkdirAll(filepath.Dir(objPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(objPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	msg = pktText("version 1") + "0000" + batchOf(content)
+	expected = pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + "0001" + pktText(oid+" 20 noop") + "0000"
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+}
+
+func TestTornObjects(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.fsync", "full")
+	content := testContent
+	oid := oidOf(content)
+	objPath := objectFile(path, oid)
+	if err := os.MkdirAll(filepath.Dir(objPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(objPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Downloads report torn objects missing without touching them.
+	size := strconv.Itoa(len(content))
+	msg := pktText("version 1") + "0000" + batchOf(content)
+	expected := pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + "0001" + pktText(oid+" "+size+" noop") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+	assert.FileExists(t, objPath)
+
+	msg = pktText("version 1") + "0000" + batchOf(content) + putObject(content) + batchOf(content)
+	expected = pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + "0001" + pktText(oid+" "+size+" upload") + "0000" +
+		pktText("status 200") + "0000" +
+		pktText("status 200") + "0001" + pktText(oid+" "+size+" noop") + "0000"
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+
+	if err := os.Truncate(objPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err := lfstransfer.Run(nil, &out, path, "fsck", "--remove-torn")
+	assert.ErrorContains(t, err, "found 1 problems")
+	assert.Contains(t, out.String(), `"type":"truncated","oid":"`+oid+`"`)
+	assert.Contains(t, out.String(), `"removed":true`)
+	assert.NoFileExists(t, objPath)
+}
+
+func TestIdempotentUpload(t *testing.T) {
+	_, path := newTestRepo(t)
+	content := testContent
+	oid := oidOf(content)
+	msg := pktText("version 1") + "0000" + putObject(content) + putObject(content) +
+		pktText("put-object "+oid) + pktText(fmt.Sprintf("size=%d", len(content))) + "0001" + pktData(strings.ToUpper(content)) + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	ok := pktText("status 200") + "0000"
+	assert.True(t, strings.HasPrefix(out.String(), pktText("version=1")+pktText("locking")+"0000"+
+		pktText("status 200")+"0001"+"0000"+ok+ok+pktText("status 400")), out.String())
+	assert.Contains(t, out.String(), "invalid object ID")
+
+	// Concurrent uploads of the same object all succeed.
+	msg = pktText("version 1") + "0000" + putObject("Another message.\n")
+	outs := make([]bytes.Buffer, 8)
+	errs := make(chan error, len(outs))
+	for i := range outs {
+		go func(w *bytes.Buffer) {
+			errs <- lfstransfer.Run(strings.NewReader(msg), w, path, "upload")
+		}(&outs[i])
+	}
+	for range outs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range outs {
+		assert.True(t, strings.HasSuffix(outs[i].String(), ok), outs[i].String())
+	}
+	entries, err := os.ReadDir(filepath.Join(path, "lfs", "incomplete"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, entries)
+}
+
+func TestUploadQuarantine(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.quarantineuploads", "true")
+	pushed := testContent
+	abandoned := "abc123"
+	oid := oidOf(pushed)
+	events := filepath.Join(t.TempDir(), "events")
+	if runtime.GOOS != "windows" {
+		hook := filepath.Join(path, "hooks", "lfs-post-upload")
+		if err := os.MkdirAll(filepath.Dir(hook), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(hook, []byte("#!/bin/sh\ncat >>"+events+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := pktText("version 1") + "0000" + putObject(pushed) + putObject(abandoned) +
+		pktText("verify-object "+oid) + pktText(fmt.Sprintf("size=%d", len(pushed))) + "0000" +
+		batchOf(pushed)
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasSuffix(out.String(), pktText(fmt.Sprintf("%s %d noop", oid, len(pushed)))+"0000"), out.String())
+	assert.NoFileExists(t, objectFile(path, oid))
+	// Objects only count as uploaded once promoted.
+	assert.NoFileExists(t, events)
+
+	// Other sessions don't see the objects quarantined by this one.
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(pktText("version 1")+"0000"+batchOf(pushed)), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), fmt.Sprintf("%s %d upload", oid, len(pushed)))
+
+	// Quarantined objects aren't served to downloaders.
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(pktText("version 1")+"0000"+batchOf(pushed)), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), fmt.Sprintf("%s %d noop", oid, len(pushed)))
+
+	head := commitFiles(t, r, plumbing.ZeroHash, map[string]string{"a.bin": pointer(pushed)})
+	updates := fmt.Sprintf("%s %s refs/heads/main\n", plumbing.ZeroHash, head)
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(updates), &out, path, "check-push"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", head)); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(updates), &out, path, "promote"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "git-lfs-transfer: promoted 1 objects\n", out.String())
+	if runtime.GOOS != "windows" {
+		b, err := os.ReadFile(events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, strings.Count(string(b), "\n"))
+		assert.Contains(t, string(b), `"oid":"`+oid+`"`)
+	}
+
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(pktText("version 1")+"0000"+batchOf(pushed)), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), fmt.Sprintf("%s %d download", oid, len(pushed)))
+
+	// The quarantine of a session still storing objects is kept.
+	if runtime.GOOS != "windows" {
+		sessions, err := os.ReadDir(filepath.Join(path, "lfs", "quarantine"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 1 {
+			t.Fatalf("expected one quarantine, got %d", len(sessions))
+		}
+		lock, err := os.Create(filepath.Join(path, "lfs", "quarantine", sessions[0].Name()+".lock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := flock.Lock(lock); err != nil {
+			t.Fatal(err)
+		}
+		out.Reset()
+		if err := lfstransfer.Run(nil, &out, path, "prune-quarantine", "--expire=0s"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, out.String(), "removed 0 quarantines, reclaimed 0 B\n")
+		flock.Unlock(lock) // nolint: errcheck
+		lock.Close()       // nolint: errcheck
+	}
+
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "prune-quarantine", "--expire=0s"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), "removed 1 quarantines, reclaimed 6 B\n")
+	entries, err := os.ReadDir(filepath.Join(path, "lfs", "quarantine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, entries)
+}
+
+func TestVerifyDownloads(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.verifydownloads", "true", "lfstransfer.verifiedcachettl", "1h")
+	good := testContent
+	bad := "abc123"
+	var msg strings.Builder
+	msg.WriteString(pktText("version 1") + "0000")
+	for _, content := range []string{good, bad} {
+		msg.WriteString(putObject(content))
+	}
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg.String()), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+
+	goodOid := oidOf(good)
+	in := pktText("version 1") + "0000" + pktText("get-object "+goodOid) + "0000"
+	expected := pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + pktText(fmt.Sprintf("size=%d", len(good))) + "0001" + pktData(good) + "0000"
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+	assert.FileExists(t, filepath.Join(path, "lfs", "verified", goodOid))
+
+	badOid := oidOf(bad)
+	badPath := objectFile(path, badOid)
+	if err := os.WriteFile(badPath, []byte("abc124"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	in = pktText("version 1") + "0000" + pktText("get-object "+badOid) + "0000" + pktText("quit") + "0000"
+	out.Reset()
+	err := lfstransfer.Run(strings.NewReader(in), &out, path, "download")
+	assert.ErrorContains(t, err, "corrupt data")
+	assert.False(t, strings.HasSuffix(out.String(), "0000"), "corrupt data must not be terminated: %q", out.String())
+	flag, err := os.ReadFile(filepath.Join(path, "lfs", "repair", badOid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(flag), "invalid object ID")
+	assert.NoFileExists(t, filepath.Join(path, "lfs", "verified", badOid))
+}
+
+func TestDeepVerify(t *testing.T) {
+	r, path := newTestRepo(t)
+	content := "abc123"
+	oid := oidOf(content)
+	size := fmt.Sprintf("size=%d", len(content))
+	upload := putObject(content)
+	in := pktText("version 1") + "0000" + upload +
+		pktText("verify-object "+oid) + pktText(size) + pktText("verify=deep") + "0000"
+	expected := pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + "0000" +
+		pktText("status 200") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+
+	objPath := objectFile(path, oid)
+	if err := os.WriteFile(objPath, []byte("abc124"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	verify := pktText("verify-object "+oid) + pktText(size) + "0000"
+	in = pktText("version 1") + "0000" + verify
+	expected = pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 200") + "0000"
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String(), "only the size is checked by default")
+
+	setConfig(t, r, "lfstransfer.deepverify", "true")
+	in = pktText("version 1") + "0000" + verify + upload + verify
+	expected = pktText("version=1") + pktText("locking") + "0000" +
+		pktText("status 200") + "0001" + "0000" +
+		pktText("status 409") + "0001" + pktText("corrupt object "+oid+", upload it again") + "0000" +
+		pktText("status 200") + "0000" +
+		pktText("status 200") + "0000"
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out.String())
+	stored, err := os.ReadFile(objPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, content, string(stored))
+	assert.FileExists(t, filepath.Join(path, "lfs", "corrupt", oid[0:2]+"-"+oid[2:4]+"-"+oid))
+}
+
+func TestScrub(t *testing.T) {
+	r, path := newTestRepo(t)
+	_, replica := newTestRepo(t)
+	contents := []string{"abc123", testContent, "lost"}
+	var msg strings.Builder
+	msg.WriteString(pktText("version 1") + "0000")
+	oids := make([]string, len(contents))
+	for i, content := range contents {
+		oids[i] = oidOf(content)
+		msg.WriteString(putObject(content))
+	}
+	for _, p := range []string{path, replica} {
+		var out bytes.Buffer
+		if err := lfstransfer.Run(strings.NewReader(msg.String()), &out, p, "upload"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first object is corrupt in both copies, the second only here.
+	for _, p := range []string{objectFile(path, oids[0]), objectFile(replica, oids[0]), objectFile(path, oids[1])} {
+		if err := os.WriteFile(p, []byte("garbage"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replicas may use another layout.
+	good := oids[1]
+	if err := os.Rename(objectFile(replica, good), filepath.Join(replica, "lfs", "objects", good[0:2], good[2:4], good[4:])); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, r, "lfstransfer.scrubreplica", filepath.Join(replica, "lfs"), "lfstransfer.scrubrate", "1MB")
+
+	var out bytes.Buffer
+	err := lfstransfer.Run(nil, &out, path, "scrub")
+	assert.ErrorContains(t, err, "found 1 problems that couldn't be repaired")
+	assert.Contains(t, out.String(), `"type":"corrupt","oid":"`+oids[1]+`"`)
+	assert.Contains(t, out.String(), `"repaired":"`+filepath.Join(replica, "lfs")+`"`)
+	assert.Contains(t, out.String(), `"checked":3`)
+	assert.Contains(t, out.String(), `"complete":true`)
+	repaired, err := os.ReadFile(objectFile(path, oids[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, contents[1], string(repaired))
+	corrupt, err := os.ReadFile(filepath.Join(path, "lfs", "corrupt", oids[1][0:2]+"-"+oids[1][2:4]+"-"+oids[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "garbage", string(corrupt))
+	// An object that can't be repaired stays in place.
+	assert.FileExists(t, objectFile(path, oids[0]))
+	assert.FileExists(t, filepath.Join(path, "lfs", "repair", oids[0]))
+	assert.NoFileExists(t, filepath.Join(path, "lfs", "repair", oids[1]))
+
+	// Resume an interrupted scrub after its checkpoint.
+	sorted := append([]string(nil), oids...)
+	sort.Strings(sorted)
+	status := fmt.Sprintf(`{"checkpoint":%q}`, sorted[0][0:2]+"/"+sorted[0][2:4]+"/"+sorted[0])
+	if err := os.WriteFile(filepath.Join(path, "lfs", "scrub", "status.json"), []byte(status), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err = lfstransfer.Run(nil, &out, path, "scrub")
+	// The first object is still corrupt, unless it was skipped.
+	if sorted[0] == oids[0] {
+		assert.NoError(t, err)
+	} else {
+		assert.ErrorContains(t, err, "found 1 problems")
+	}
+	assert.Contains(t, out.String(), `"checked":2`)
+}
+
+func TestCleanup(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.cleanuponstartup", "false")
+	old := time.Now().Add(-48 * time.Hour)
+	touch := func(path string, mtime time.Time) string {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// A lock temp file left behind by a killed process doesn't block the
+	// path forever.
+	id := "d76670443f4d5ecdeea34c12793917498e18e858c6f74cd38c4b794273bb5e28"
+	touch(filepath.Join(path, "lfs", "locks", id+".lock"), old)
+	msg := pktText("version 1") + "0000" + pktText("lock") + pktText("path=foo") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), pktText("status 201"))
+	assert.NoFileExists(t, filepath.Join(path, "lfs", "locks", id+".lock"))
+
+	stale := []string{
+		touch(filepath.Join(path, "lfs", "incomplete", strings.Repeat("a", 64)+"0123456789abcdef01234567"), old),
+		touch(filepath.Join(path, "lfs", "incomplete", strings.Repeat("b", 64)+".lock"), old),
+		touch(filepath.Join(path, "lfs", "locks", strings.Repeat("c", 64)+".lock"), old),
+	}
+	fresh := touch(filepath.Join(path, "lfs", "incomplete", strings.Repeat("d", 64)+"0123456789abcdef01234567"), time.Now())
+
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "cleanup", "--dry-run"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), "would remove 3 files, reclaiming 21 B\n")
+	for _, p := range stale {
+		assert.FileExists(t, p)
+	}
+
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "cleanup"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range stale {
+		assert.Contains(t, out.String(), "removed "+p+" 7\n")
+		assert.NoFileExists(t, p)
+	}
+	assert.Contains(t, out.String(), "removed 3 files, reclaimed 21 B\n")
+	assert.FileExists(t, fresh)
+
+	// Sessions clean up when they start.
+	setConfig(t, r, "lfstransfer.cleanuponstartup", "true")
+	touch(stale[0], old)
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(pktText("version 1")+"0000"), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoFileExists(t, stale[0])
+	assert.FileExists(t, fresh)
+}
+
+func TestRateLimit(t *testing.T) {
+	r, path := newTestRepo(t)
+	stateDir := t.TempDir()
+	setConfig(t, r, "lfstransfer.uploadrate", "40000", "lfstransfer.hostdownloadrate", "40000",
+		"lfstransfer.rateburst", "1", "lfstransfer.ratestatedir", stateDir)
+	content := strings.Repeat("x", 20000)
+	oid := oidOf(content)
+
+	msg := pktText("version 1") + "0000" + putObject(content)
+	var out bytes.Buffer
+	start := time.Now()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	assert.Contains(t, out.String(), pktText("status 200")+"0000")
+
+	msg = pktText("version 1") + "0000" + pktText("get-object "+oid) + "0000"
+	out.Reset()
+	start = time.Now()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	assert.True(t, strings.HasSuffix(out.String(), pktData(content)+"0000"))
+	assert.FileExists(t, filepath.Join(stateDir, strconv.Itoa(os.Geteuid()), "download-rate"))
+
+	// By default, the host limits are shared by every repository of the host.
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	cfg, err := r.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Raw.Section("lfstransfer").RemoveOption("ratestatedir")
+	if err := r.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+	assert.FileExists(t, filepath.Join(os.TempDir(), "git-lfs-transfer-ratelimit", strconv.Itoa(os.Geteuid()), "download-rate"))
+}
+
+func TestIdentityEnvUnset(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.identityenv", "TEST_LFS_IDENTITY")
+	t.Setenv("TEST_LFS_IDENTITY", "")
+	msg := pktText("version 1") + "0000" + pktText("lock") + pktText("path=foo") + "0000"
+	var out bytes.Buffer
+	err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload")
+	assert.ErrorContains(t, err, "no identity: TEST_LFS_IDENTITY is not set")
+	assert.NoFileExists(t, filepath.Join(path, "lfs", "locks", fmt.Sprintf("%x", sha256.Sum256([]byte("v1:foo")))))
+}
+
+func TestRequestRateLimit(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.identityenv", "TEST_LFS_IDENTITY")
+	cfg, err := r.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Raw.Section("lfstransfer").Subsection("list-lock").SetOption("requestRate", "2")
+	if err := r.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_LFS_IDENTITY", "alice")
+
+	listLock := pktText("list-lock") + pktText("limit=100") + "0000"
+	msg := pktText("version 1") + "0000" + listLock + listLock + listLock +
+		pktText("lock") + pktText("path=foo") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, strings.Count(out.String(), pktText("status 429")), out.String())
+	assert.Regexp(t, `status 429\n00..retry-after=(30|31)\n`, out.String())
+	assert.Contains(t, out.String(), "error: too many requests: list-lock requests are rate limited, retry in 3")
+	assert.Contains(t, out.String(), pktText("status 201"))
+
+	// The limit is per identity, and shared by every session.
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(pktText("version 1")+"0000"+listLock), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), pktText("status 429"))
+	assert.FileExists(t, filepath.Join(path, "lfs", "ratelimit", strconv.Itoa(os.Geteuid()), "requests-alice-list-lock"))
+	t.Setenv("TEST_LFS_IDENTITY", "bob")
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(pktText("version 1")+"0000"+listLock), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, out.String(), pktText("status 429"))
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// Every user keeps their state in their own directory, which other users
+	// may not write to.
+	shared := t.TempDir()
+	if err := os.Chmod(shared, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, r, "lfstransfer.ratestatedir", shared)
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(msg), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, strings.Count(out.String(), pktText("status 429")), out.String())
+	userDir := filepath.Join(shared, strconv.Itoa(os.Geteuid()))
+	assert.FileExists(t, filepath.Join(userDir, "requests-bob-list-lock"))
+	if err := os.Chmod(userDir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	err = lfstransfer.Run(strings.NewReader(msg), &out, path, "upload")
+	assert.ErrorContains(t, err, "unusable rate limit state directory")
+	assert.ErrorContains(t, err, "writable by other users")
+}
+
+func TestAuditLog(t *testing.T) {
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.auditlog", "audit/lfs.log", "lfstransfer.auditlogmaxsize", "1KB",
+		"lfstransfer.identityenv", "TEST_LFS_IDENTITY")
+	t.Setenv("TEST_LFS_IDENTITY", "alice")
+	content := testContent
+	oid := oidOf(content)
+	lockID := fmt.Sprintf("%x", sha256.Sum256([]byte("v1:foo")))
+	in := pktText("version 1") + "0000" +
+		batchOf(content) +
+		putObject(content) +
+		pktText("lock") + pktText("path=foo") + "0000" +
+		pktText("unlock "+lockID) + "0000" +
+		pktText("get-object") + "0000" +
+		pktText("list-lock") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_LFS_IDENTITY", "bob")
+	in = pktText("version 1") + "0000" + pktText("get-object "+oid) + "0000"
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "download"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "audit", "lfs.log*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	// Rotated files sort before the current one, which has no suffix.
+	files = append(files[1:], files[0])
+	assert.Greater(t, len(files), 2, "the log should have been rotated")
+	type record struct {
+		Identity   string `json:"identity"`
+		Repository string `json:"repository"`
+		Operation  string `json:"operation"`
+		Command    string `json:"command"`
+		Oid        string `json:"oid"`
+		Size       int64  `json:"size"`
+		Objects    []struct {
+			Oid string `json:"oid"`
+		} `json:"objects"`
+		Path   string `json:"path"`
+		LockID string `json:"lock_id"`
+		Status uint32 `json:"status"`
+	}
+	var records []record
+	var lines []string
+	for _, file := range files {
+		if strings.HasSuffix(file, ".lock") {
+			continue
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var entry struct {
+				Event record `json:"event"`
+			}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, entry.Event)
+			lines = append(lines, file)
+		}
+	}
+	if !assert.Len(t, records, 6) {
+		return
+	}
+	for _, rec := range records {
+		assert.NotEmpty(t, rec.Repository)
+	}
+	assert.Equal(t, "batch", records[0].Command)
+	assert.Equal(t, oid, records[0].Objects[0].Oid)
+	assert.Equal(t, int64(len(content)), records[0].Size)
+	assert.Equal(t, record{Identity: "alice", Repository: records[1].Repository, Operation: "upload", Command: "put-object",
+		Oid: oid, Size: int64(len(content)), Status: 200}, records[1])
+	assert.Equal(t, record{Identity: "alice", Repository: records[2].Repository, Operation: "upload", Command: "lock",
+		Path: "foo", LockID: lockID, Status: 201}, records[2])
+	assert.Equal(t, record{Identity: "alice", Repository: records[3].Repository, Operation: "upload", Command: "unlock",
+		Path: "foo", LockID: lockID, Status: 200}, records[3])
+	assert.Equal(t, "get-object", records[4].Command)
+	assert.Equal(t, uint32(400), records[4].Status)
+	assert.Equal(t, record{Identity: "bob", Repository: records[5].Repository, Operation: "download", Command: "get-object",
+		Oid: oid, Size: int64(len(content)), Status: 200}, records[5])
+
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "verify-audit"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "verified 6 entries\n", out.String())
+
+	// Altering an entry breaks the chain.
+	b, err := os.ReadFile(lines[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(b), `"identity":"alice"`, `"identity":"carol"`, 1)
+	if err := os.WriteFile(lines[1], []byte(tampered), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = lfstransfer.Run(nil, &out, path, "verify-audit")
+	assert.ErrorContains(t, err, "doesn't match its hash")
+}
+
+func TestAuditLogKey(t *testing.T) {
+	r, path := newTestRepo(t)
+	keyFile := filepath.Join(t.TempDir(), "audit.key")
+	if err := os.WriteFile(keyFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, r, "lfstransfer.auditlog", "lfs.log", "lfstransfer.auditlogkeyfile", keyFile)
+	in := pktText("version 1") + "0000" + pktText("lock") + pktText("path=foo") + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := lfstransfer.Run(nil, &out, path, "verify-audit"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "verified 1 entries\n", out.String())
+
+	// Rewriting the last entry takes the key.
+	b, err := os.ReadFile(filepath.Join(path, "lfs.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry struct {
+		Event json.RawMessage `json:"event"`
+		Prev  string          `json:"prev"`
+		Hash  string          `json:"hash"`
+	}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		t.Fatal(err)
+	}
+	entry.Event = json.RawMessage(strings.Replace(string(entry.Event), `"path":"foo"`, `"path":"bar"`, 1))
+	entry.Hash = fmt.Sprintf("%x", sha256.Sum256([]byte(entry.Prev+"\n"+string(entry.Event))))
+	tampered, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "lfs.log"), append(tampered, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = lfstransfer.Run(nil, &out, path, "verify-audit")
+	assert.ErrorContains(t, err, "doesn't match its hash")
+}
+
+func TestHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts")
+	}
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.identityenv", "TEST_LFS_IDENTITY")
+	t.Setenv("TEST_LFS_IDENTITY", "alice")
+	good := testContent
+	banned := "banned"
+	goodOid := oidOf(good)
+	bannedOid := oidOf(banned)
+	events := filepath.Join(t.TempDir(), "events")
+	hooksDir := filepath.Join(path, "hooks")
+	if err := os.MkdirAll(hooksDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, script := range map[string]string{
+		"lfs-pre-upload":  "if grep -q " + bannedOid + "; then echo 'banned content' >&2; exit 1; fi\n",
+		"lfs-post-upload": "cat >>" + events + "\n",
+		"lfs-post-lock":   "cat >>" + events + "\n",
+		"lfs-post-unlock": "cat >>" + events + "\n",
+	} {
+		if err := os.WriteFile(filepath.Join(hooksDir, name), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lockID := fmt.Sprintf("%x", sha256.Sum256([]byte("v1:foo")))
+	in := pktText("version 1") + "0000" +
+		putObject(banned) +
+		putObject(good) +
+		pktText("lock") + pktText("path=foo") + "0000" +
+		pktText("lock") + pktText("path=foo") + "0000" +
+		pktText("unlock "+lockID) + "0000"
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), pktText("status 403")+"0001"+
+		pktText("error: forbidden: object "+bannedOid+" refused by the lfs-pre-upload hook: banned content"))
+	assert.NoFileExists(t, objectFile(path, bannedOid))
+	assert.FileExists(t, objectFile(path, goodOid))
+
+	b, err := os.ReadFile(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var e struct {
+			Identity string `json:"identity"`
+			Command  string `json:"command"`
+			Oid      string `json:"oid"`
+			Path     string `json:"path"`
+		}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, strings.Join([]string{e.Identity, e.Command, e.Oid, e.Path}, " "))
+	}
+	// The conflicting lock doesn't run the post-lock hook.
+	assert.Equal(t, []string{
+		"alice put-object " + goodOid + " ",
+		"alice lock  foo",
+		"alice unlock  foo",
+	}, got)
+}
+
+func TestHookTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts")
+	}
+	r, path := newTestRepo(t)
+	setConfig(t, r, "lfstransfer.hooktimeout", "100ms")
+	hooksDir := filepath.Join(path, "hooks")
+	if err := os.MkdirAll(hooksDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(hooksDir, "lfs-pre-upload"), []byte("#!/bin/sh\nsleep 10\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	oid := oidOf(testContent)
+	var out bytes.Buffer
+	start := time.Now()
+	if err := lfstransfer.Run(strings.NewReader(pktText("version 1")+"0000"+putObject(testContent)), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Contains(t, out.String(), pktText("status 403")+"0001"+
+		pktText("error: forbidden: object "+oid+" refused by the lfs-pre-upload hook: timed out after 100ms"))
+	assert.NoFileExists(t, objectFile(path, oid))
+}
+
+// fakeClamdMaxLength is the StreamMaxLength of fakeClamd.
+const fakeClamdMaxLength = 256 << 10
+
+// fakeClamd serves clamd's INSTREAM command on a Unix socket, finding a virus
+// in streams containing "EICAR". Like clamd, it replies with an error and
+// hangs up as soon as a stream goes over its StreamMaxLength.
+func fakeClamd(tb testing.TB) string {
+	tb.Helper()
+	dir, err := os.MkdirTemp("", "clamd")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "clamd.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+				conn.Close()
+				continue
+			}
+			var data []byte
+			reply := "stream: OK\x00"
+			for {
+				var n uint32
+				if err := binary.Read(r, binary.BigEndian, &n); err != nil || n == 0 {
+					break
+				}
+				chunk := make([]byte, n)
+				if _, err := io.ReadFull(r, chunk); err != nil {
+					break
+				}
+				data = append(data, chunk...)
+				if len(data) > fakeClamdMaxLength {
+					reply = "INSTREAM size limit exceeded. ERROR\x00"
+					break
+				}
+			}
+			if bytes.Contains(data, []byte("EICAR")) {
+				reply = "stream: Eicar-Test-Signature FOUND\x00"
+			}
+			conn.Write([]byte(reply))
+			conn.Close()
+		}
+	}()
+	return socket
+}
+
+func TestScanner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the scanners need Unix sockets and a shell")
+	}
+	r, path := newTestRepo(t)
+	script := filepath.Join(t.TempDir(), "scan")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nif head -c 4 \"$1\" | grep -q '^%PDF'; then echo 'PDF files are banned'; exit 1; fi\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, r, "lfstransfer.clamd", fakeClamd(t), "lfstransfer.scancommand", script)
+	good := testContent
+	virus := "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"
+	pdf := "%PDF-1.7\n"
+	oids := map[string]string{}
+	in := pktText("version 1") + "0000"
+	for _, content := range []string{virus, pdf, good} {
+		oid := oidOf(content)
+		oids[content] = oid
+		in += putObject(content)
+	}
+	var out bytes.Buffer
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), pktText("error: forbidden: object "+oids[virus]+" rejected by clamd: Eicar-Test-Signature FOUND"))
+	assert.Contains(t, out.String(), pktText("error: forbidden: object "+oids[pdf]+" rejected by the scan command: PDF files are banned"))
+	assert.True(t, strings.HasSuffix(out.String(), pktText("status 200")+"0000"), out.String())
+	for content, oid := range oids {
+		objPath := objectFile(path, oid)
+		if content == good {
+			assert.FileExists(t, objPath)
+		} else {
+			assert.NoFileExists(t, objPath)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(path, "lfs", "incomplete"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, entries, "temporary files must be removed")
+
+	// Objects clamd can't scan are refused as too large, unless they are
+	// over lfstransfer.scanMaxSize, which skips their scan.
+	large := strings.Repeat("x", 2*fakeClamdMaxLength)
+	in = pktText("version 1") + "0000" + putObject(large)
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), pktText("status 413")+"0001"+
+		pktText("error: too large: object "+oidOf(large)+" is larger than clamd can scan"))
+	assert.NoFileExists(t, objectFile(path, oidOf(large)))
+	setConfig(t, r, "lfstransfer.scanmaxsize", strconv.Itoa(fakeClamdMaxLength))
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(in), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasSuffix(out.String(), pktText("status 200")+"0000"), out.String())
+	assert.FileExists(t, objectFile(path, oidOf(large)))
+
+	// A scan that times out fails the upload without refusing the object.
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexec sleep 10\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, r, "lfstransfer.scantimeout", "100ms")
+	slow := "slow to scan"
+	out.Reset()
+	if err := lfstransfer.Run(strings.NewReader(pktText("version 1")+"0000"+putObject(slow)), &out, path, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), pktText("status 500"))
+	assert.NotContains(t, out.String(), pktText("status 403"))
+	assert.NoFileExists(t, objectFile(path, oidOf(slow)))
+}
@@ -7,21 +7,12 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
 
-	"github.com/git-lfs/git-lfs/v3/git"
 	"golang.org/x/sys/unix"
 )
 
-func setPermissions(path string) os.FileMode {
-	var config *git.Configuration
-	if strings.HasSuffix(path, ".git") {
-		config = git.NewReadOnlyConfig(path, path)
-	} else {
-		config = git.NewReadOnlyConfig(path, "")
-	}
+func setPermissions(sr string) os.FileMode {
 	var val int
-	sr := config.Find("core.sharedrepository")
 	switch sr {
 	case "true", "group":
 		val = 0660
@@ -43,3 +34,8 @@ func setPermissions(path string) os.FileMode {
 func setup(c chan os.Signal) {
 	signal.Notify(c, os.Interrupt, unix.SIGTERM, unix.SIGPIPE)
 }
+
+// isExecutable reports whether a file may be run.
+func isExecutable(info os.FileInfo) bool {
+	return info.Mode()&0111 != 0
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+	"github.com/git-lfs/git-lfs/v3/tools/humanize"
+)
+
+// configSection is the git config section holding git-lfs-transfer settings.
+const configSection = "lfstransfer"
+
+// config holds the git-lfs-transfer settings of a repository, along with the
+// rest of its git config.
+type config struct {
+	gitdir string
+	values map[string][]string
+}
+
+// gitConfig runs git config with args against the repository at gitdir and
+// returns its output. GIT_DIR is set for the command alone: the one in the
+// environment may be relative to the directory the session started in,
+// while git runs from gitdir.
+func gitConfig(gitdir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"config"}, args...)...)
+	cmd.Dir = gitdir
+	cmd.Env = append(os.Environ(), "GIT_DIR="+gitdir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+// loadConfig reads the git config of the repository at gitdir.
+func loadConfig(gitdir string) *config {
+	c := &config{gitdir: gitdir, values: map[string][]string{}}
+	out, err := gitConfig(gitdir, "--includes", "--null", "--list")
+	if err != nil {
+		logger.Log("error reading git config", "err", err)
+		return c
+	}
+	for _, entry := range strings.Split(out, "\x00") {
+		key, value, _ := strings.Cut(entry, "\n")
+		if key != "" {
+			c.values[key] = append(c.values[key], value)
+		}
+	}
+	return c
+}
+
+// Git returns the last value of key, a setting outside of the git-lfs-transfer
+// section such as "core.hooksPath", or an empty string if it's not set.
+func (c *config) Git(key string) string {
+	vals := c.values[strings.ToLower(key)]
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[len(vals)-1]
+}
+
+// String returns the last value of key, or def if it's not set.
+func (c *config) String(key, def string) string {
+	vals := c.values[configSection+"."+key]
+	if len(vals) == 0 {
+		return def
+	}
+	return vals[len(vals)-1]
+}
+
+// Set sets key to value in the repository's local git config.
+func (c *config) Set(key, value string) error {
+	if _, err := gitConfig(c.gitdir, "--local", configSection+"."+key, value); err != nil {
+		return fmt.Errorf("error updating config: %w", err)
+	}
+	c.values[configSection+"."+key] = []string{value}
+	return nil
+}
+
+// Unset removes key from the repository's local git config.
+func (c *config) Unset(key string) error {
+	if _, err := gitConfig(c.gitdir, "--local", "--unset", configSection+"."+key); err != nil {
+		return fmt.Errorf("error updating config: %w", err)
+	}
+	delete(c.values, configSection+"."+key)
+	return nil
+}
+
+// Strings returns all the values of key, in order.
+func (c *config) Strings(key string) []string {
+	return c.values[configSection+"."+key]
+}
+
+// Bool returns key as a boolean, or def if it's not set.
+func (c *config) Bool(key string, def bool) (bool, error) {
+	v := c.String(key, "")
+	switch strings.ToLower(v) {
+	case "":
+		return def, nil
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean value for %s.%s: %q", configSection, key, v)
+	}
+}
+
+// Size returns key as a number of bytes, or def if it's not set. Values may
+// carry a unit suffix such as "10MB" or "1GiB".
+func (c *config) Size(key string, def int64) (int64, error) {
+	v := c.String(key, "")
+	if v == "" {
+		return def, nil
+	}
+	n, err := humanize.ParseBytes(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size for %s.%s: %q", configSection, key, v)
+	}
+	return int64(n), nil
+}
+
+// Duration returns key as a duration such as "90s" or "12h", or def if it's
+// not set.
+func (c *config) Duration(key string, def time.Duration) (time.Duration, error) {
+	v := c.String(key, "")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration for %s.%s: %q", configSection, key, v)
+	}
+	return d, nil
+}
+
+// backendOptions returns the local backend options for the given config.
+func backendOptions(cfg *config) ([]local.Option, error) {
+	var opts []local.Option
+	layout, err := local.ParseLayout(cfg.String("layout", local.DefaultLayout.Name()))
+	if err != nil {
+		return nil, err
+	}
+	var previous []local.Layout
+	if name := cfg.String("previouslayout", ""); name != "" {
+		prev, err := local.ParseLayout(name)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, prev)
+	}
+	opts = append(opts, local.WithLayout(layout, previous...))
+	algo, err := local.ParseCompression(cfg.String("compression", local.CompressionNone))
+	if err != nil {
+		return nil, err
+	}
+	if algo != local.CompressionNone {
+		minSize, err := cfg.Size("compressionminsize", 4096)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, local.WithCompression(algo, minSize))
+	}
+	if pool := cfg.String("sharedpool", ""); pool != "" {
+		if !filepath.IsAbs(pool) {
+			return nil, fmt.Errorf("%s.sharedPool must be an absolute path: %q", configSection, pool)
+		}
+		opts = append(opts, local.WithSharedPool(pool))
+	}
+	quota, err := cfg.Size("quota", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxObject, err := cfg.Size("maxobjectsize", 0)
+	if err != nil {
+		return nil, err
+	}
+	if quota > 0 || maxObject > 0 {
+		opts = append(opts, local.WithQuota(quota, maxObject))
+	}
+	fsync, err := local.ParseFsync(cfg.String("fsync", local.FsyncNone))
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, local.WithFsync(fsync))
+	reserve, err := cfg.Size("minfreespace", 0)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, local.WithMinFreeSpace(reserve), local.WithLogger(logger))
+	deep, err := cfg.Bool("deepverify", false)
+	if err != nil {
+		return nil, err
+	}
+	if deep {
+		opts = append(opts, local.WithDeepVerify())
+	}
+	ttl, err := cfg.Duration("verifiedcachettl", 0)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		opts = append(opts, local.WithVerifiedCache(ttl))
+	}
+	return opts, nil
+}
+
+// dedupUnsupported lists the settings the dedup backend doesn't honor, with
+// the values that leave them off.
+var dedupUnsupported = []struct {
+	key string
+	off []string
+}{
+	{"compression", []string{"", "none"}},
+	{"sharedpool", []string{""}},
+	{"quota", []string{"", "0"}},
+	{"maxobjectsize", []string{"", "0"}},
+	{"minfreespace", []string{"", "0"}},
+	{"quarantineuploads", []string{"", "false", "no", "off", "0"}},
+	{"deepverify", []string{"", "false", "no", "off", "0"}},
+	{"verifiedcachettl", []string{"", "0", "0s"}},
+	{"fsync", []string{"", "none"}},
+	{"layout", []string{"", "default"}},
+	{"previouslayout", []string{""}},
+	{"clamd", []string{""}},
+	{"scancommand", []string{""}},
+}
+
+// checkDedupConfig returns an error if cfg turns on a setting the dedup
+// backend doesn't honor, so that it doesn't go silently ignored.
+func checkDedupConfig(cfg *config) error {
+	for _, u := range dedupUnsupported {
+		v := strings.ToLower(cfg.String(u.key, ""))
+		if !slices.Contains(u.off, v) {
+			return fmt.Errorf("%s.%s is not supported by the dedup backend", configSection, u.key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+// eventObject is an object of a batch request in an event record.
+type eventObject struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// eventRecord is the record of a request written to the audit log and passed
+// to hooks.
+type eventRecord struct {
+	Time       time.Time     `json:"time"`
+	Identity   string        `json:"identity"`
+	Repository string        `json:"repository"`
+	Operation  string        `json:"operation"`
+	Command    string        `json:"command"`
+	Oid        string        `json:"oid,omitempty"`
+	Size       int64         `json:"size,omitempty"`
+	Objects    []eventObject `json:"objects,omitempty"`
+	Path       string        `json:"path,omitempty"`
+	LockID     string        `json:"lock_id,omitempty"`
+	Status     uint32        `json:"status"`
+	Error      string        `json:"error,omitempty"`
+	DurationMs int64         `json:"duration_ms"`
+}
+
+// newEventRecord returns the record of the request described by e, served for
+// identity in repository.
+func newEventRecord(e transfer.Event, identity, repository string) eventRecord {
+	rec := eventRecord{
+		Time:       e.Time.UTC(),
+		Identity:   identity,
+		Repository: repository,
+		Operation:  e.Operation,
+		Command:    e.Command,
+		Oid:        e.Oid,
+		Size:       e.Size,
+		Path:       e.Path,
+		LockID:     e.LockID,
+		Status:     e.Status,
+		DurationMs: e.Duration.Milliseconds(),
+	}
+	for _, p := range e.Objects {
+		rec.Objects = append(rec.Objects, eventObject{Oid: p.Oid, Size: p.Size})
+	}
+	if e.Err != nil {
+		rec.Error = e.Err.Error()
+	}
+	return rec
+}
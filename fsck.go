@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+)
+
+const fsckOperation = "fsck"
+
+// fsckSummary is the last record written by fsck.
+type fsckSummary struct {
+	Kind     string `json:"type"`
+	Checked  int    `json:"checked"`
+	Problems int    `json:"problems"`
+}
+
+// fsck verifies the integrity of the stored objects and writes the problems
+// found as JSON lines.
+func fsck(w io.Writer, repo *repository, args ...string) error {
+	flags := flag.NewFlagSet(fsckOperation, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	quarantine := flags.Bool("quarantine", false, "move bad objects to lfs/corrupt")
+	removeTorn := flags.Bool("remove-torn", false, "delete truncated objects so they can be uploaded again")
+	stale := flags.Duration("stale", 24*time.Hour, "age after which temporary files are reported")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if flags.NArg() != 0 {
+		return usageErrorf("%s: unexpected arguments: %v", fsckOperation, flags.Args())
+	}
+	if kind := repo.config.String("backend", "local"); kind != "local" {
+		return fmt.Errorf("%s is not supported by the %s backend", fsckOperation, kind)
+	}
+	lb, err := repo.localBackend()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	problems := 0
+	opts := local.FsckOptions{
+		StaleAge:   *stale,
+		Quarantine: *quarantine,
+		RemoveTorn: *removeTorn,
+	}
+	checked, err := lb.Fsck(opts, func(p local.Problem) error {
+		problems++
+		return enc.Encode(p)
+	})
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(fsckSummary{Kind: "summary", Checked: checked, Problems: problems}); err != nil {
+		return err
+	}
+	if problems > 0 {
+		return fmt.Errorf("%w: %s found %d problems", errProblemsFound, fsckOperation, problems)
+	}
+	return nil
+}
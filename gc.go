@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/dedup"
+	"github.com/charmbracelet/git-lfs-transfer/internal/lfsgit"
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+	"github.com/git-lfs/git-lfs/v3/tools/humanize"
+)
+
+const gcOperation = "gc"
+
+// defaultGCGracePeriod is how old an unreferenced object must be before gc
+// prunes it. It leaves time for objects uploaded ahead of a push to become
+// referenced.
+const defaultGCGracePeriod = 14 * 24 * time.Hour
+
+// gc prunes the objects that no ref of the repository points to anymore.
+// It doesn't know about the repositories using this one as an alternate, so
+// it must not run on their parent.
+func gc(w io.Writer, repo *repository, args ...string) error {
+	flags := flag.NewFlagSet(gcOperation, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	dryRun := flags.Bool("dry-run", false, "only report what would be pruned")
+	grace := flags.Duration("grace", defaultGCGracePeriod, "minimum age of pruned objects")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if flags.NArg() != 0 {
+		return usageErrorf("%s: unexpected arguments: %v", gcOperation, flags.Args())
+	}
+	backend, err := repo.backend()
+	if err != nil {
+		return err
+	}
+	r, err := repo.git()
+	if err != nil {
+		return err
+	}
+	tips, err := lfsgit.RefHashes(r.Storer)
+	if err != nil {
+		return err
+	}
+	reachable := map[string]struct{}{}
+	err = lfsgit.NewWalker(r.Storer).Pointers(tips, func(e lfsgit.Entry) error {
+		reachable[e.Oid] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	keep := func(oid string) bool {
+		_, ok := reachable[oid]
+		return ok
+	}
+	verb, summary := "pruned", "pruned %d objects, reclaimed %s\n"
+	if *dryRun {
+		verb, summary = "would prune", "would prune %d objects, reclaiming %s\n"
+	}
+	var count, total int64
+	before := repo.now.Add(-*grace)
+	switch b := backend.(type) {
+	case *local.LocalBackend:
+		err = b.Prune(keep, before, *dryRun, func(oid string, size int64) {
+			count++
+			total += size
+			fmt.Fprintf(w, "%s %s %d\n", verb, oid, size)
+		})
+	case *dedup.DedupBackend:
+		// Objects share chunks, so only the chunks pruned free up space.
+		err = b.Prune(keep, before, *dryRun, func(oid string, size int64) {
+			count++
+			fmt.Fprintf(w, "%s %s %d\n", verb, oid, size)
+		}, func(hash string, size int64) {
+			total += size
+			fmt.Fprintf(w, "%s chunk %s %d\n", verb, hash, size)
+		})
+	default:
+		return fmt.Errorf("%s is not supported by the %s backend", gcOperation, repo.config.String("backend", "local"))
+	}
+	fmt.Fprintf(w, summary, count, humanize.FormatBytes(uint64(total)))
+	return err
+}
@@ -5,7 +5,10 @@ go 1.25.0
 require (
 	github.com/git-lfs/git-lfs/v3 v3.7.1
 	github.com/git-lfs/pktline v0.0.0-20230103162542-ca444d533ef1
+	github.com/git-lfs/wildmatch/v2 v2.0.1
+	github.com/go-git/go-billy/v5 v5.8.0
 	github.com/go-git/go-git/v5 v5.17.0
+	github.com/klauspost/compress v1.18.0
 	github.com/rubyist/tracerx v0.0.0-20170927163412-787959303086
 	github.com/stretchr/testify v1.11.1
 	golang.org/x/sys v0.42.0
@@ -21,9 +24,7 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/emirpasic/gods v1.18.1 // indirect
 	github.com/git-lfs/gitobj/v2 v2.1.1 // indirect
-	github.com/git-lfs/wildmatch/v2 v2.0.1 // indirect
 	github.com/go-git/gcfg v1.5.1-0.20230307220236-3a3c6141e376 // indirect
-	github.com/go-git/go-billy/v5 v5.8.0 // indirect
 	github.com/golang/groupcache v0.0.0-20241129210726-2c02b8208cf8 // indirect
 	github.com/jbenet/go-context v0.0.0-20150711004518-d14ea06fba99 // indirect
 	github.com/kevinburke/ssh_config v1.2.0 // indirect
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+// Hooks run by upload and download sessions, looked up in the repository's
+// hooks directory.
+const (
+	preUploadHook  = "lfs-pre-upload"
+	postUploadHook = "lfs-post-upload"
+	postLockHook   = "lfs-post-lock"
+	postUnlockHook = "lfs-post-unlock"
+)
+
+// defaultHookTimeout is how long hooks may run before they are killed.
+const defaultHookTimeout = time.Minute
+
+// errHookTimeout is returned when a hook is killed for running too long.
+var errHookTimeout = errors.New("timed out")
+
+// uploadRequest is the event passed to the pre-upload hook.
+type uploadRequest struct {
+	Time       time.Time `json:"time"`
+	Identity   string    `json:"identity"`
+	Repository string    `json:"repository"`
+	Oid        string    `json:"oid"`
+	Size       int64     `json:"size"`
+}
+
+// hooks runs the hook executables of a repository. Their standard output and
+// error go to the session's log, since the session's standard error isn't
+// shown to users by Git LFS.
+type hooks struct {
+	dir        string
+	gitdir     string
+	identity   string
+	repository string
+	// quarantine is set when uploads are quarantined, in which case the
+	// post-upload hook runs when promote moves them into the store.
+	quarantine bool
+	// timeout is how long hooks may run, zero if they may run forever.
+	timeout time.Duration
+}
+
+var (
+	_ transfer.UploadPolicy = &hooks{}
+	_ transfer.EventSink    = &hooks{}
+)
+
+// hooksDir returns the repository's hooks directory: `core.hooksPath`, relative
+// to the Git directory, when it's set, and `hooks` in the common Git directory
+// otherwise.
+func (r *repository) hooksDir() string {
+	dir := r.config.Git("core.hooksPath")
+	switch {
+	case dir == "":
+		return filepath.Join(r.commonDir, "hooks")
+	case filepath.IsAbs(dir):
+		return dir
+	default:
+		return filepath.Join(r.gitdir, dir)
+	}
+}
+
+// hooks returns the hooks of the repository, or nil if it has none.
+func (r *repository) hooks() (*hooks, error) {
+	h := &hooks{dir: r.hooksDir(), gitdir: r.gitdir, repository: r.commonDir}
+	found := false
+	for _, name := range []string{preUploadHook, postUploadHook, postLockHook, postUnlockHook} {
+		if h.hook(name) != "" {
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	identity, err := r.identity()
+	if err != nil {
+		return nil, err
+	}
+	h.identity = identity
+	if h.quarantine, err = r.config.Bool("quarantineuploads", false); err != nil {
+		return nil, err
+	}
+	if h.timeout, err = r.config.Duration("hooktimeout", defaultHookTimeout); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// hook returns the path of the hook called name, or an empty string if it
+// doesn't exist or isn't executable.
+func (h *hooks) hook(name string) string {
+	path := filepath.Join(h.dir, name)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || !isExecutable(info) {
+		return ""
+	}
+	return path
+}
+
+// run runs the hook at path from the Git directory, with event as JSON on its
+// standard input, and returns its combined output. Hooks running longer than
+// the timeout are killed, and an error wrapping errHookTimeout returned.
+func (h *hooks) run(path string, event any) ([]byte, error) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = h.gitdir
+	cmd.Env = append(os.Environ(), "GIT_DIR="+h.gitdir)
+	cmd.Stdin = bytes.NewReader(append(b, '\n'))
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Don't wait for background processes still holding the output.
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return out.Bytes(), fmt.Errorf("%w after %s", errHookTimeout, h.timeout)
+	}
+	return out.Bytes(), err
+}
+
+// logOutput logs the output of the hook called name, if any.
+func logOutput(name string, out []byte) {
+	if out := strings.TrimSpace(string(out)); out != "" {
+		logger.Log("hook output", "hook", name, "output", out)
+	}
+}
+
+// CheckUpload implements transfer.UploadPolicy. Objects are refused when the
+// pre-upload hook exits with an error, giving the first line of its output as
+// the reason, or when it times out.
+func (h *hooks) CheckUpload(oid string, size int64) error {
+	path := h.hook(preUploadHook)
+	if path == "" {
+		return nil
+	}
+	out, err := h.run(path, uploadRequest{
+		Time:       time.Now().UTC(),
+		Identity:   h.identity,
+		Repository: h.repository,
+		Oid:        oid,
+		Size:       size,
+	})
+	if errors.Is(err, errHookTimeout) {
+		logOutput(preUploadHook, out)
+		return fmt.Errorf("%w: object %s refused by the %s hook: %s", transfer.ErrForbidden, oid, preUploadHook, err)
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		reason, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		if reason == "" {
+			reason = exit.Error()
+		}
+		return fmt.Errorf("%w: object %s refused by the %s hook: %s", transfer.ErrForbidden, oid, preUploadHook, reason)
+	}
+	if err != nil {
+		return fmt.Errorf("error running the %s hook: %w", preUploadHook, err)
+	}
+	logOutput(preUploadHook, out)
+	return nil
+}
+
+// Record implements transfer.EventSink. It runs the post-upload, post-lock and
+// post-unlock hooks after successful put-object, lock and unlock requests.
+// Quarantined uploads run the post-upload hook when they are promoted instead.
+func (h *hooks) Record(e transfer.Event) error {
+	var name string
+	switch {
+	case e.Err != nil:
+		return nil
+	case e.Command == "put-object" && e.Status == transfer.StatusOK && !h.quarantine:
+		name = postUploadHook
+	case e.Command == "lock" && e.Status == transfer.StatusCreated:
+		name = postLockHook
+	case e.Command == "unlock" && e.Status == transfer.StatusOK:
+		name = postUnlockHook
+	default:
+		return nil
+	}
+	return h.runEvent(name, e)
+}
+
+// runEvent runs the hook called name, if it exists, with the record of e.
+func (h *hooks) runEvent(name string, e transfer.Event) error {
+	path := h.hook(name)
+	if path == "" {
+		return nil
+	}
+	out, err := h.run(path, newEventRecord(e, h.identity, h.repository))
+	logOutput(name, out)
+	if err != nil {
+		return fmt.Errorf("error running the %s hook: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+)
+
+// identity returns the name of the user the session is served for: the value
+// of the environment variable named by `lfstransfer.identityEnv` when it's
+// set, as with servers serving every user from the same system account, and
+// the name of the system user otherwise. When the variable is configured but
+// empty, it's an error rather than the shared account's name, which would
+// make every session the same user.
+func (r *repository) identity() (string, error) {
+	if name := r.config.String("identityenv", ""); name != "" {
+		id := os.Getenv(name)
+		if id == "" {
+			return "", fmt.Errorf("no identity: %s is not set", name)
+		}
+		return id, nil
+	}
+	user, err := local.CurrentUser()
+	if err != nil {
+		return "", fmt.Errorf("error getting current user: %w", err)
+	}
+	return user, nil
+}
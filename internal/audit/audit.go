@@ -0,0 +1,392 @@
+// Package audit writes tamper-evident logs of JSON lines. Each entry carries
+// the hash of the previous one, so that changing, inserting or removing an
+// entry breaks the chain of hashes after it.
+//
+// Without a key, the chain only protects the entries followed by others
+// whose hashes can be trusted: anyone able to write the log can rewrite its
+// last entries and recompute their hashes, or truncate it. With a key, the
+// hashes are HMACs that can't be recomputed without it, but removing the last
+// entries still goes unnoticed.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/flock"
+)
+
+// Entry is a line of an audit log.
+type Entry struct {
+	// Event is the record logged, as JSON.
+	Event json.RawMessage `json:"event"`
+	// Prev is the hash of the previous entry, empty for the first entry of
+	// the log.
+	Prev string `json:"prev"`
+	// Hash is the hash of the entry, covering Prev and Event.
+	Hash string `json:"hash"`
+}
+
+// hash returns the hash of an entry logging event after the entry whose hash
+// is prev, an HMAC if the log has a key.
+func (l *Log) hash(prev string, event []byte) string {
+	h := sha256.New()
+	if l.key != nil {
+		h = hmac.New(sha256.New, l.key)
+	}
+	h.Write([]byte(prev))
+	h.Write([]byte{'\n'})
+	h.Write(event)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// rotatedTimeFormat is the format of the suffix of rotated log files, which
+// sorts them by age.
+const rotatedTimeFormat = "20060102T150405.000000000Z"
+
+// Log is an audit log file, rotated once it grows over a maximum size.
+// Several processes may append to the same log.
+type Log struct {
+	path    string
+	maxSize int64
+	keep    int
+	key     []byte
+}
+
+// New returns the audit log at path. Once the file reaches maxSize bytes, it
+// is renamed with the time of the rotation as suffix and a new one is started,
+// continuing the chain of hashes. Only the keep most recent rotated files are
+// kept. A maxSize of zero or less disables rotation, and a keep of zero or
+// less keeps every rotated file. Entries are hashed with HMAC-SHA256 keyed
+// with key, unless it's nil.
+func New(path string, maxSize int64, keep int, key []byte) *Log {
+	return &Log{path: path, maxSize: maxSize, keep: keep, key: key}
+}
+
+// Append appends an entry logging v, marshaled as JSON, to the log. A torn
+// last line left by an interrupted write is moved aside first, see
+// recoverTail.
+func (l *Log) Append(v any) error {
+	event, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0777); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(l.path+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer lock.Close() // nolint: errcheck
+	if err := flock.Lock(lock); err != nil {
+		return err
+	}
+	defer flock.Unlock(lock) // nolint: errcheck
+	torn, err := l.recoverTail()
+	if err != nil {
+		return err
+	}
+	prev, err := l.head()
+	if err != nil {
+		return err
+	}
+	var lines []byte
+	events := [][]byte{event}
+	if torn > 0 {
+		rec, err := json.Marshal(recovery{Type: "recovery", TornBytes: torn, SavedTo: l.tornPath()})
+		if err != nil {
+			return err
+		}
+		events = [][]byte{rec, event}
+	}
+	for _, ev := range events {
+		entry := Entry{Event: ev, Prev: prev, Hash: l.hash(prev, ev)}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+		prev = entry.Hash
+	}
+	if err := l.rotate(int64(len(lines))); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(lines); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	return f.Close()
+}
+
+// recovery is the event of the entry appended after a torn last line was
+// removed from the log.
+type recovery struct {
+	Type      string `json:"type"`
+	TornBytes int64  `json:"torn_bytes"`
+	SavedTo   string `json:"saved_to"`
+}
+
+// tornPath returns the path of the file torn lines are saved to.
+func (l *Log) tornPath() string {
+	return l.path + ".torn"
+}
+
+// recoverTail makes sure the current file of the log ends with a complete
+// entry, so that entries can be appended after it. A last line that isn't a
+// valid entry, such as one torn by an interrupted write, would otherwise break
+// every append: it's moved to the end of the file at tornPath, and its size
+// returned so that the recovery is recorded in the log. The chain continues
+// from the last valid entry.
+func (l *Log) recoverTail() (int64, error) {
+	line, off, err := lastLine(l.path)
+	if err != nil || line == nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close() // nolint: errcheck
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var e Entry
+	if json.Unmarshal(line, &e) == nil {
+		// Only the newline may be missing.
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+			return 0, err
+		}
+		if last[0] != '\n' {
+			_, err = f.WriteAt([]byte{'\n'}, info.Size())
+		}
+		return 0, err
+	}
+	torn := make([]byte, info.Size()-off)
+	if _, err := f.ReadAt(torn, off); err != nil {
+		return 0, err
+	}
+	if !bytes.HasSuffix(torn, []byte{'\n'}) {
+		torn = append(torn, '\n')
+	}
+	saved, err := os.OpenFile(l.tornPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := saved.Write(torn); err != nil {
+		saved.Close() // nolint: errcheck
+		return 0, err
+	}
+	if err := saved.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size() - off, f.Truncate(off)
+}
+
+// head returns the hash of the last entry of the log, looking into the most
+// recent rotated file when the log was just rotated.
+func (l *Log) head() (string, error) {
+	files, err := l.Files()
+	if err != nil {
+		return "", err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		line, _, err := lastLine(files[i])
+		if err != nil {
+			return "", err
+		}
+		if line == nil {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return "", fmt.Errorf("%s: invalid last entry: %w", files[i], err)
+		}
+		return e.Hash, nil
+	}
+	return "", nil
+}
+
+// lastLine returns the last line of the file at path and its offset, or nil
+// if it's empty or doesn't exist.
+func lastLine(path string) ([]byte, int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close() // nolint: errcheck
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	end := info.Size()
+	var line []byte
+	buf := make([]byte, 4096)
+	for off := end; off > 0; {
+		n := int64(len(buf))
+		if off < n {
+			n = off
+		}
+		off -= n
+		if _, err := f.ReadAt(buf[:n], off); err != nil {
+			return nil, 0, err
+		}
+		line = append(append([]byte(nil), buf[:n]...), line...)
+		trimmed := bytes.TrimRight(line, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], off + int64(i) + 1, nil
+		}
+	}
+	line = bytes.TrimRight(line, "\n")
+	if len(line) == 0 {
+		return nil, 0, nil
+	}
+	return line, 0, nil
+}
+
+// rotate rotates the log if appending n bytes would take it over its maximum
+// size.
+func (l *Log) rotate(n int64) error {
+	if l.maxSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 || info.Size()+n <= l.maxSize {
+		return nil
+	}
+	rotated := l.path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	if l.keep <= 0 {
+		return nil
+	}
+	files, err := l.Files()
+	if err != nil {
+		return err
+	}
+	// The current file doesn't exist until the entry is written.
+	for len(files) > l.keep {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// Files returns the files of the log that exist, from the oldest rotated file
+// to the current one.
+func (l *Log) Files() ([]string, error) {
+	dir, base := filepath.Split(l.path)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	var current bool
+	for _, e := range entries {
+		name := e.Name()
+		if name == base {
+			current = true
+			continue
+		}
+		suffix, ok := strings.CutPrefix(name, base+".")
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(rotatedTimeFormat, suffix); err == nil {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(files)
+	if current {
+		files = append(files, l.path)
+	}
+	return files, nil
+}
+
+// Verify checks the chain of hashes of the log, from the oldest rotated file
+// kept to the current one, and returns the number of entries checked. The
+// first entry kept may follow entries of rotated files removed since, so its
+// previous hash is taken as is.
+func (l *Log) Verify() (int, error) {
+	files, err := l.Files()
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	prev, first := "", true
+	for _, file := range files {
+		n, err := l.verifyFile(file, &prev, &first)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// verifyFile checks the entries of file, following the entry whose hash is
+// prev unless first is set.
+func (l *Log) verifyFile(file string, prev *string, first *bool) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close() // nolint: errcheck
+	r := bufio.NewReader(f)
+	var count int
+	for lineno := 1; ; lineno++ {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return count, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return count, err
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return count, fmt.Errorf("%s:%d: invalid entry: %w", file, lineno, err)
+		}
+		if !*first && e.Prev != *prev {
+			return count, fmt.Errorf("%s:%d: entry doesn't follow the previous one", file, lineno)
+		}
+		if !hmac.Equal([]byte(l.hash(e.Prev, e.Event)), []byte(e.Hash)) {
+			return count, fmt.Errorf("%s:%d: entry doesn't match its hash", file, lineno)
+		}
+		*prev, *first = e.Hash, false
+		count++
+	}
+}
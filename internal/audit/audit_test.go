@@ -0,0 +1,196 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// appendEvents appends n events numbered from 0 to l.
+func appendEvents(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := l.Append(map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readLines returns the lines of the file at path.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	return lines[:len(lines)-1]
+}
+
+// writeLines replaces the file at path with lines.
+func writeLines(t *testing.T, path string, lines []string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := New(path, 0, 0, nil)
+	n, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Zero(t, n)
+	appendEvents(t, l, 3)
+	n, err = l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, n)
+
+	lines := readLines(t, path)
+	var first, second Entry
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, first.Prev)
+	assert.Equal(t, first.Hash, second.Prev)
+}
+
+func TestVerifyTampering(t *testing.T) {
+	for name, tc := range map[string]struct {
+		tamper func([]string) []string
+		err    string
+	}{
+		"changed event": {
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `{"n":1}`, `{"n":9}`, 1)
+				return lines
+			},
+			err: "audit.log:2: entry doesn't match its hash",
+		},
+		"removed entry": {
+			tamper: func(lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			err: "audit.log:2: entry doesn't follow the previous one",
+		},
+		"swapped entries": {
+			tamper: func(lines []string) []string {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			err: "audit.log:2: entry doesn't follow the previous one",
+		},
+		"invalid entry": {
+			tamper: func(lines []string) []string {
+				lines[2] = "garbage\n"
+				return lines
+			},
+			err: "audit.log:3: invalid entry",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			l := New(path, 0, 0, nil)
+			appendEvents(t, l, 3)
+			writeLines(t, path, tc.tamper(readLines(t, path)))
+			_, err := l.Verify()
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestVerifyKeyed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := New(path, 0, 0, []byte("secret"))
+	appendEvents(t, l, 2)
+	n, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, n)
+
+	// The hashes can't be checked, nor recomputed, without the key.
+	_, err = New(path, 0, 0, nil).Verify()
+	assert.ErrorContains(t, err, "audit.log:1: entry doesn't match its hash")
+	_, err = New(path, 0, 0, []byte("guess")).Verify()
+	assert.ErrorContains(t, err, "audit.log:1: entry doesn't match its hash")
+}
+
+func TestVerifyRotated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// Every entry but the first of a file rotates it.
+	l := New(path, 1, 2, nil)
+	appendEvents(t, l, 4)
+	files, err := l.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, files, 3)
+	assert.Equal(t, path, files[2])
+
+	// The chain continues across files, the oldest of which were removed.
+	n, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, n)
+
+	// Removing a rotated file in the middle breaks it.
+	if err := os.Remove(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.Verify()
+	assert.ErrorContains(t, err, "audit.log:1: entry doesn't follow the previous one")
+}
+
+func TestAppendTorn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := New(path, 0, 0, nil)
+	appendEvents(t, l, 2)
+
+	// A write interrupted before its newline is completed.
+	lines := readLines(t, path)
+	writeLines(t, path, []string{lines[0], strings.TrimSuffix(lines[1], "\n")})
+	appendEvents(t, l, 1)
+	n, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, n)
+
+	// A torn line is moved aside, and a recovery entry continues the chain
+	// from the last complete one.
+	lines = readLines(t, path)
+	torn := lines[2][:len(lines[2])/2]
+	writeLines(t, path, []string{lines[0], lines[1], torn})
+	appendEvents(t, l, 1)
+	n, err = l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, n)
+	lines = readLines(t, path)
+	var e Entry
+	if err := json.Unmarshal([]byte(lines[2]), &e); err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `{"type":"recovery","torn_bytes":`+strconv.Itoa(len(torn))+`,"saved_to":"`+path+`.torn"}`, string(e.Event))
+	assert.Equal(t, []string{torn + "\n"}, readLines(t, path+".torn"))
+	files, err := l.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{path}, files)
+}
@@ -0,0 +1,375 @@
+package dedup
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+var _ transfer.Backend = &DedupBackend{}
+
+// relativePath returns the storage path of a hash relative to its root.
+func relativePath(hash string) string {
+	p := transfer.Pointer{Oid: hash}
+	return strings.ReplaceAll(p.RelativePath(), "/", string(filepath.Separator))
+}
+
+// DedupBackend is a Git LFS backend that splits objects into content-defined
+// chunks and stores each distinct chunk once. Locks are delegated to the
+// local backend.
+type DedupBackend struct { // nolint: revive
+	lfsPath string
+	local   *local.LocalBackend
+}
+
+// New creates a new deduplicating backend. lfsPath should be a `.git/lfs`
+// directory.
+func New(lfsPath string, local *local.LocalBackend) *DedupBackend {
+	return &DedupBackend{
+		lfsPath: lfsPath,
+		local:   local,
+	}
+}
+
+func (d *DedupBackend) manifestPath(oid string) string {
+	return filepath.Join(d.lfsPath, "manifests", relativePath(oid))
+}
+
+func (d *DedupBackend) chunkPath(hash string) string {
+	return filepath.Join(d.lfsPath, "chunks", relativePath(hash))
+}
+
+func (d *DedupBackend) readManifest(oid string) (*manifest, error) {
+	f, err := os.Open(d.manifestPath(oid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	m, err := readManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: manifest for %s: %s", transfer.ErrCorruptData, oid, err)
+	}
+	return m, nil
+}
+
+// Batch implements main.Backend.
+func (d *DedupBackend) Batch(_ string, pointers []transfer.BatchItem, _ transfer.Args) ([]transfer.BatchItem, error) {
+	for i := range pointers {
+		present := false
+		m, err := d.readManifest(pointers[i].Oid)
+		if err == nil {
+			pointers[i].Size = m.Size
+			present = true
+		}
+		pointers[i].Present = present
+	}
+	return pointers, nil
+}
+
+// StatObject implements transfer.ObjectStater.
+func (d *DedupBackend) StatObject(oid string) (int64, error) {
+	m, err := d.readManifest(oid)
+	if err != nil {
+		return 0, err
+	}
+	return m.Size, nil
+}
+
+// Download implements main.Backend. The returned reader must be closed by the
+// caller. Every chunk, and the reassembled object, is verified against its
+// hash as it is read.
+func (d *DedupBackend) Download(oid string, _ transfer.Args) (io.ReadCloser, int64, error) {
+	m, err := d.readManifest(oid)
+	if err != nil {
+		return nil, 0, err
+	}
+	cr := &chunkReader{backend: d, chunks: m.Chunks}
+	return &readCloser{
+		Reader: transfer.NewVerifyingReader(cr, sha256.New(), oid, m.Size),
+		Closer: cr,
+	}, m.Size, nil
+}
+
+// LockBackend implements main.Backend.
+func (d *DedupBackend) LockBackend(args transfer.Args) transfer.LockBackend {
+	return d.local.LockBackend(args)
+}
+
+// Upload implements main.Backend. The manifest is only written once the whole
+// stream has been read, so an object whose stream fails verification is
+// never reported as present. Chunks new to the store are kept in temporary
+// files until then too, so that a failed upload leaves none behind.
+func (d *DedupBackend) Upload(oid string, _ int64, r io.Reader, _ transfer.Args) error {
+	if r == nil {
+		return fmt.Errorf("%w: received null data", transfer.ErrMissingData)
+	}
+	m := &manifest{}
+	staged := map[string]string{}
+	defer func() {
+		for _, temp := range staged {
+			os.Remove(temp) // nolint: errcheck
+		}
+	}()
+	c := NewChunker(r)
+	for {
+		chunk, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		if _, ok := staged[hash]; !ok && !d.reuseChunk(hash, int64(len(chunk))) {
+			temp, err := d.writeTemp(hash, func(w io.Writer) error {
+				_, err := w.Write(chunk)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			staged[hash] = temp
+		}
+		m.Chunks = append(m.Chunks, chunkRef{Hash: hash, Size: int64(len(chunk))})
+		m.Size += int64(len(chunk))
+	}
+	for hash, temp := range staged {
+		// An identical chunk stored meanwhile is as good as ours.
+		if err := d.link(temp, d.chunkPath(hash)); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	err := d.writeFile(d.manifestPath(oid), func(w io.Writer) error {
+		_, err := m.WriteTo(w)
+		return err
+	})
+	if errors.Is(err, fs.ErrExist) {
+		// Another upload of the same object won the race.
+		return nil
+	}
+	return err
+}
+
+// hasChunk reports whether the chunk hash is stored with the given size.
+func (d *DedupBackend) hasChunk(hash string, size int64) bool {
+	info, err := os.Stat(d.chunkPath(hash))
+	return err == nil && info.Size() == size
+}
+
+// reuseChunk reports whether the chunk hash is stored with the given size,
+// and touches it so that Prune keeps it until the manifest of the upload
+// reusing it is written.
+func (d *DedupBackend) reuseChunk(hash string, size int64) bool {
+	if !d.hasChunk(hash, size) {
+		return false
+	}
+	now := time.Now()
+	return os.Chtimes(d.chunkPath(hash), now, now) == nil
+}
+
+// writeFile atomically creates the file at path with the contents written by
+// fn. It returns an error wrapping fs.ErrExist if the file already exists.
+func (d *DedupBackend) writeFile(path string, fn func(io.Writer) error) error {
+	temp, err := d.writeTemp(filepath.Base(path), fn)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp) // nolint: errcheck
+	return d.link(temp, path)
+}
+
+// writeTemp creates a temporary file named after name in `lfs/incomplete`
+// with the contents written by fn, and returns its path.
+func (d *DedupBackend) writeTemp(name string, fn func(io.Writer) error) (string, error) {
+	randBytes := make([]byte, 12)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
+	}
+	tempFile := filepath.Join(d.lfsPath, "incomplete", fmt.Sprintf("%s%x", name, randBytes))
+	f, err := os.Create(tempFile)
+	if err != nil {
+		return "", err
+	}
+	err = fn(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tempFile) // nolint: errcheck
+		return "", err
+	}
+	return tempFile, nil
+}
+
+// link makes the temporary file temp visible at path. It returns an error
+// wrapping fs.ErrExist if the file already exists.
+func (d *DedupBackend) link(temp, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	if err := os.Link(temp, path); err != nil {
+		return err
+	}
+	if _, err := d.local.FixPermissions(path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Verify implements main.Backend.
+func (d *DedupBackend) Verify(oid string, size int64, _ transfer.Args) (transfer.Status, error) {
+	if size == 0 {
+		return nil, fmt.Errorf("missing size argument")
+	}
+	m, err := d.readManifest(oid)
+	if errors.Is(err, fs.ErrNotExist) {
+		return transfer.NewStatus(transfer.StatusNotFound, "not found"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Size != size {
+		return transfer.NewStatus(transfer.StatusConflict, "size mismatch"), nil
+	}
+	for _, c := range m.Chunks {
+		info, err := os.Stat(d.chunkPath(c.Hash))
+		if err != nil {
+			return transfer.NewStatus(transfer.StatusConflict, "missing chunk"), nil
+		}
+		if info.Size() != c.Size {
+			return transfer.NewStatus(transfer.StatusConflict, "chunk size mismatch"), nil
+		}
+	}
+	return transfer.SuccessStatus(), nil
+}
+
+// Stats holds the deduplication statistics of a repository.
+type Stats struct {
+	// Objects is the number of stored objects.
+	Objects int64
+	// Chunks is the number of distinct stored chunks.
+	Chunks int64
+	// LogicalSize is the total size of all stored objects.
+	LogicalSize int64
+	// StoredSize is the total size of all stored chunks.
+	StoredSize int64
+}
+
+// Ratio returns the deduplication ratio, the logical size divided by the
+// stored size.
+func (s Stats) Ratio() float64 {
+	if s.StoredSize == 0 {
+		return 1
+	}
+	return float64(s.LogicalSize) / float64(s.StoredSize)
+}
+
+// Stats computes the deduplication statistics of the repository.
+func (d *DedupBackend) Stats() (Stats, error) {
+	var s Stats
+	err := walkFiles(filepath.Join(d.lfsPath, "manifests"), func(path string, _ fs.FileInfo) error {
+		m, err := d.readManifest(filepath.Base(path))
+		if err != nil {
+			return err
+		}
+		s.Objects++
+		s.LogicalSize += m.Size
+		return nil
+	})
+	if err != nil {
+		return s, err
+	}
+	err = walkFiles(filepath.Join(d.lfsPath, "chunks"), func(_ string, info fs.FileInfo) error {
+		s.Chunks++
+		s.StoredSize += info.Size()
+		return nil
+	})
+	return s, err
+}
+
+// walkFiles calls fn for every regular file under root. A missing root is
+// treated as empty.
+func walkFiles(root string, fn func(path string, info fs.FileInfo) error) error {
+	err := filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !de.Type().IsRegular() {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// chunkReader reads the chunks of an object in order, verifying each one.
+type chunkReader struct {
+	backend *DedupBackend
+	chunks  []chunkRef
+	f       *os.File
+	r       io.Reader
+}
+
+// Read implements io.Reader.
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			ref := c.chunks[0]
+			c.chunks = c.chunks[1:]
+			f, err := os.Open(c.backend.chunkPath(ref.Hash))
+			if err != nil {
+				return 0, err
+			}
+			c.f = f
+			c.r = transfer.NewVerifyingReader(f, sha256.New(), ref.Hash, ref.Size)
+		}
+		n, err := c.r.Read(p)
+		if errors.Is(err, io.EOF) {
+			c.Close() // nolint: errcheck
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close implements io.Closer.
+func (c *chunkReader) Close() error {
+	c.r = nil
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+// readCloser combines a reader with a separate closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,126 @@
+package dedup
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestBackend returns a dedup backend storing objects in a new directory.
+func newTestBackend(t *testing.T) *DedupBackend {
+	t.Helper()
+	lfsPath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(lfsPath, "incomplete"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	return New(lfsPath, local.New(lfsPath, 0o022, &now))
+}
+
+// upload stores content, returning its object ID.
+func upload(t *testing.T, d *DedupBackend, content []byte) string {
+	t.Helper()
+	oid := fmt.Sprintf("%x", sha256.Sum256(content))
+	if err := d.Upload(oid, int64(len(content)), strings.NewReader(string(content)), transfer.Args{}); err != nil {
+		t.Fatal(err)
+	}
+	return oid
+}
+
+func TestVerifyChunks(t *testing.T) {
+	d := newTestBackend(t)
+	content := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(content)
+	oid := upload(t, d, content)
+	size := int64(len(content))
+
+	status, err := d.Verify(oid, size, transfer.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint32(transfer.StatusOK), status.Code())
+
+	m, err := d.readManifest(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := d.chunkPath(m.Chunks[0].Hash)
+	if err := os.Truncate(chunk, m.Chunks[0].Size-1); err != nil {
+		t.Fatal(err)
+	}
+	status, err = d.Verify(oid, size, transfer.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint32(transfer.StatusConflict), status.Code())
+	assert.Equal(t, []string{"chunk size mismatch"}, status.Messages())
+
+	if err := os.Remove(chunk); err != nil {
+		t.Fatal(err)
+	}
+	status, err = d.Verify(oid, size, transfer.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"missing chunk"}, status.Messages())
+}
+
+func TestPrune(t *testing.T) {
+	d := newTestBackend(t)
+	rnd := rand.New(rand.NewSource(1))
+	shared := make([]byte, 128<<10)
+	rnd.Read(shared)
+	unique := make([]byte, 128<<10)
+	rnd.Read(unique)
+	kept := upload(t, d, shared)
+	pruned := upload(t, d, append(append([]byte(nil), shared...), unique...))
+	keep := func(oid string) bool { return oid == kept }
+
+	var objects, chunks []string
+	report := func(oid string, _ int64) { objects = append(objects, oid) }
+	reportChunk := func(hash string, _ int64) { chunks = append(chunks, hash) }
+
+	// Recent manifests and chunks are kept.
+	if err := d.Prune(keep, time.Now().Add(-time.Hour), false, report, reportChunk); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, objects)
+	assert.Empty(t, chunks)
+
+	if err := d.Prune(keep, time.Now().Add(time.Hour), true, report, reportChunk); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{pruned}, objects)
+	assert.NotEmpty(t, chunks)
+	assert.FileExists(t, d.manifestPath(pruned))
+
+	objects, chunks = nil, nil
+	if err := d.Prune(keep, time.Now().Add(time.Hour), false, report, reportChunk); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{pruned}, objects)
+	assert.NoFileExists(t, d.manifestPath(pruned))
+	for _, hash := range chunks {
+		assert.NoFileExists(t, d.chunkPath(hash))
+	}
+	// The chunks of the object kept are left alone.
+	status, err := d.Verify(kept, int64(len(shared)), transfer.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint32(transfer.StatusOK), status.Code())
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(len(shared)), stats.StoredSize)
+}
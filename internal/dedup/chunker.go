@@ -0,0 +1,110 @@
+package dedup
+
+import (
+	"io"
+)
+
+// Chunk size bounds used by the content-defined chunker. They must never
+// change for an existing store, or identical content would be split
+// differently and stop deduplicating.
+const (
+	minChunkSize = 16 << 10
+	avgChunkSize = 64 << 10
+	maxChunkSize = 256 << 10
+)
+
+// Cut-point masks. Below the average chunk size a stricter mask makes cuts
+// less likely, above it a looser one makes them more likely, which keeps chunk
+// sizes close to the average (normalized chunking).
+const (
+	maskStrict uint64 = 0xffffc00000000000 // top 18 bits
+	maskLoose  uint64 = 0xfffc000000000000 // top 14 bits
+)
+
+// gear is the table of random values used by the rolling gear hash.
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed, so the table is stable across builds.
+	seed := uint64(0x6c66732d7472616e)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// cutPoint returns the length of the next chunk at the start of data.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	normal := avgChunkSize
+	if normal > n {
+		normal = n
+	}
+	var fp uint64
+	i := minChunkSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskStrict == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskLoose == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Chunker splits a stream into content-defined chunks.
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	off int
+	n   int
+	eof bool
+}
+
+// NewChunker creates a new chunker reading from r.
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, 2*maxChunkSize),
+	}
+}
+
+// Next returns the next chunk. The returned slice is only valid until the
+// next call to Next. It returns io.EOF once the stream is exhausted.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.n-c.off < maxChunkSize && !c.eof {
+		copy(c.buf, c.buf[c.off:c.n])
+		c.n -= c.off
+		c.off = 0
+		for c.n < len(c.buf) && !c.eof {
+			m, err := c.r.Read(c.buf[c.n:])
+			c.n += m
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.off == c.n {
+		return nil, io.EOF
+	}
+	cut := cutPoint(c.buf[c.off:c.n])
+	chunk := c.buf[c.off : c.off+cut]
+	c.off += cut
+	return chunk, nil
+}
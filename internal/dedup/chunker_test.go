@@ -0,0 +1,79 @@
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chunks splits data with a Chunker, returning copies of the chunks.
+func chunks(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	var out [][]byte
+	c := NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerBounds(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	got := chunks(t, data)
+	assert.Equal(t, data, bytes.Join(got, nil))
+	for i, c := range got {
+		assert.LessOrEqual(t, len(c), maxChunkSize)
+		if i < len(got)-1 {
+			assert.GreaterOrEqual(t, len(c), minChunkSize)
+		}
+	}
+	// Random data is cut close to the average chunk size.
+	avg := len(data) / len(got)
+	assert.Greater(t, avg, minChunkSize)
+	assert.Less(t, avg, 2*avgChunkSize)
+}
+
+func TestChunkerSmall(t *testing.T) {
+	assert.Empty(t, chunks(t, nil))
+	assert.Equal(t, [][]byte{[]byte("abc")}, chunks(t, []byte("abc")))
+	// Content without cut points is cut at the maximum size.
+	assert.Equal(t, []int{maxChunkSize, 10}, lengths(chunks(t, make([]byte, maxChunkSize+10))))
+}
+
+func TestChunkerShift(t *testing.T) {
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	hashes := map[[32]byte]struct{}{}
+	for _, c := range chunks(t, data) {
+		hashes[sha256.Sum256(c)] = struct{}{}
+	}
+	// Inserting data at the start only changes the first chunks.
+	shifted := chunks(t, append([]byte("inserted"), data...))
+	shared := 0
+	for _, c := range shifted {
+		if _, ok := hashes[sha256.Sum256(c)]; ok {
+			shared++
+		}
+	}
+	assert.GreaterOrEqual(t, shared, len(shifted)-2)
+}
+
+func lengths(chunks [][]byte) []int {
+	var n []int
+	for _, c := range chunks {
+		n = append(n, len(c))
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+package dedup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// manifestVersion is the version of the manifest format.
+const manifestVersion = "v1"
+
+// chunkRef references a stored chunk.
+type chunkRef struct {
+	Hash string
+	Size int64
+}
+
+// manifest lists the chunks an object is made of, in order.
+type manifest struct {
+	Size   int64
+	Chunks []chunkRef
+}
+
+// WriteTo writes the manifest in its text format.
+func (m *manifest) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "version %s\n", manifestVersion)
+	fmt.Fprintf(&b, "size %d\n", m.Size)
+	for _, c := range m.Chunks {
+		fmt.Fprintf(&b, "chunk %s %d\n", c.Hash, c.Size)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// readManifest parses a manifest.
+func readManifest(r io.Reader) (*manifest, error) {
+	m := &manifest{}
+	s := bufio.NewScanner(r)
+	line := 0
+	var total int64
+	for s.Scan() {
+		line++
+		fields := strings.Fields(s.Text())
+		switch {
+		case line == 1:
+			if len(fields) != 2 || fields[0] != "version" || fields[1] != manifestVersion {
+				return nil, fmt.Errorf("unsupported manifest version: %q", s.Text())
+			}
+		case len(fields) == 2 && fields[0] == "size":
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid manifest size: %q", s.Text())
+			}
+			m.Size = size
+		case len(fields) == 3 && fields[0] == "chunk":
+			size, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid manifest chunk: %q", s.Text())
+			}
+			m.Chunks = append(m.Chunks, chunkRef{Hash: fields[1], Size: size})
+			total += size
+		default:
+			return nil, fmt.Errorf("invalid manifest line: %q", s.Text())
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if line == 0 {
+		return nil, fmt.Errorf("empty manifest")
+	}
+	if total != m.Size {
+		return nil, fmt.Errorf("manifest size mismatch: expected %d, got %d", m.Size, total)
+	}
+	return m, nil
+}
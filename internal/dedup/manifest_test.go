@@ -0,0 +1,39 @@
+package dedup
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	m := &manifest{Size: 30, Chunks: []chunkRef{{Hash: "aa", Size: 10}, {Hash: "bb", Size: 20}}}
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "version v1\nsize 30\nchunk aa 10\nchunk bb 20\n", b.String())
+	got, err := readManifest(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, m, got)
+}
+
+func TestManifestInvalid(t *testing.T) {
+	for input, msg := range map[string]string{
+		"":                                        "empty manifest",
+		"version v2\nsize 0\n":                    "unsupported manifest version",
+		"size 0\n":                                "unsupported manifest version",
+		"version v1\nsize ten\n":                  "invalid manifest size",
+		"version v1\nsize 10\nchunk aa ten\n":     "invalid manifest chunk",
+		"version v1\nsize 10\nextra\n":            "invalid manifest line",
+		"version v1\nsize 30\nchunk aa 10\n":      "manifest size mismatch: expected 30, got 10",
+		"version v1\nsize 10\nchunk aa 10 more\n": "invalid manifest line",
+	} {
+		_, err := readManifest(strings.NewReader(input))
+		assert.ErrorContains(t, err, msg, input)
+	}
+}
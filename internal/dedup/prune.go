@@ -0,0 +1,58 @@
+package dedup
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Prune removes the manifests of the objects for which keep returns false and
+// that were last modified before the given time, then the chunks no remaining
+// manifest references that were last modified before it too. report is called
+// with the object ID and size of every pruned object, and reportChunk with the
+// hash and size of every pruned chunk. Nothing is removed when dryRun is set.
+//
+// Uploads touch the stored chunks they reuse, so that the chunks of an object
+// whose manifest isn't written yet are never older than the given time.
+func (d *DedupBackend) Prune(keep func(oid string) bool, before time.Time, dryRun bool, report, reportChunk func(id string, size int64)) error {
+	referenced := map[string]struct{}{}
+	err := walkFiles(filepath.Join(d.lfsPath, "manifests"), func(path string, info fs.FileInfo) error {
+		oid := filepath.Base(path)
+		m, err := d.readManifest(oid)
+		if err != nil {
+			// Its chunks can't be told apart from unreferenced ones.
+			return fmt.Errorf("error reading manifest, not pruning: %w", err)
+		}
+		if keep(oid) || !info.ModTime().Before(before) {
+			for _, c := range m.Chunks {
+				referenced[c.Hash] = struct{}{}
+			}
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		report(oid, m.Size)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return walkFiles(filepath.Join(d.lfsPath, "chunks"), func(path string, info fs.FileInfo) error {
+		hash := filepath.Base(path)
+		if _, ok := referenced[hash]; ok || !info.ModTime().Before(before) {
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		reportChunk(hash, info.Size())
+		return nil
+	})
+}
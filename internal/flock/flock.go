@@ -0,0 +1,3 @@
+// Package flock takes advisory locks on files, shared by every process
+// opening them.
+package flock
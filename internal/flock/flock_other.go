@@ -0,0 +1,21 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package flock
+
+import "os"
+
+// Lock is a no-op on platforms without advisory file locks.
+func Lock(*os.File) error {
+	return nil
+}
+
+// TryLock is a no-op on platforms without advisory file locks.
+func TryLock(*os.File) (bool, error) {
+	return true, nil
+}
+
+// Unlock is a no-op on platforms without advisory file locks.
+func Unlock(*os.File) error {
+	return nil
+}
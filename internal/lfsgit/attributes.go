@@ -0,0 +1,97 @@
+package lfsgit
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/git-lfs/git-lfs/v3/git/gitattr"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Attributes reads the gitattributes of the paths of a tree from the
+// .gitattributes files it contains. Files are read on demand and cached.
+type Attributes struct {
+	tree   *object.Tree
+	macros *gitattr.MacroProcessor
+	files  map[string][]gitattr.PatternLine
+}
+
+// NewAttributes returns the attributes defined in tree.
+func NewAttributes(tree *object.Tree) *Attributes {
+	return &Attributes{
+		tree:   tree,
+		macros: gitattr.NewMacroProcessor(),
+		files:  map[string][]gitattr.PatternLine{},
+	}
+}
+
+// Value returns the value of attribute key for path, and whether it is set.
+// Like git, patterns from .gitattributes files deeper in the tree take
+// precedence, as do later lines within a file.
+func (a *Attributes) Value(p, key string) (string, bool, error) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	// Go from the top-level file, the only one allowed to define macros,
+	// down to the deepest one.
+	var dirs []string
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	dirs = append([]string{""}, dirs...)
+	var value string
+	var set bool
+	for _, dir := range dirs {
+		lines, err := a.file(dir)
+		if err != nil {
+			return "", false, err
+		}
+		rel := strings.TrimPrefix(p, dir+"/")
+		for _, line := range lines {
+			if !line.Pattern().Match(rel) {
+				continue
+			}
+			for _, attr := range line.Attrs() {
+				if attr.K != key {
+					continue
+				}
+				value, set = attr.V, !attr.Unspecified
+			}
+		}
+	}
+	return value, set, nil
+}
+
+// Lockable reports whether path has the lockable attribute set.
+func (a *Attributes) Lockable(p string) (bool, error) {
+	v, ok, err := a.Value(p, "lockable")
+	return ok && v == "true", err
+}
+
+// file returns the pattern lines of the .gitattributes file in dir.
+func (a *Attributes) file(dir string) ([]gitattr.PatternLine, error) {
+	if lines, ok := a.files[dir]; ok {
+		return lines, nil
+	}
+	name := path.Join(dir, ".gitattributes")
+	f, err := a.tree.File(name)
+	if errors.Is(err, object.ErrFileNotFound) {
+		a.files[dir] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	r, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close() // nolint: errcheck
+	parsed, _, err := gitattr.ParseLines(r)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", name, err)
+	}
+	lines := a.macros.ProcessLines(parsed, dir == "")
+	a.files[dir] = lines
+	return lines, nil
+}
@@ -0,0 +1,71 @@
+package lfsgit
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ChangedPaths returns the paths a commit adds, modifies or removes. Root
+// commits are compared against the empty tree. Merge commits only report the
+// paths that differ from every parent, that is the changes made by the merge
+// itself rather than the ones it brings in.
+func ChangedPaths(c *object.Commit) ([]string, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("error reading tree of commit %s: %w", c.Hash, err)
+	}
+	if c.NumParents() == 0 {
+		return diffPaths(nil, tree)
+	}
+	counts := map[string]int{}
+	err = c.Parents().ForEach(func(parent *object.Commit) error {
+		ptree, err := parent.Tree()
+		if err != nil {
+			return fmt.Errorf("error reading tree of commit %s: %w", parent.Hash, err)
+		}
+		paths, err := diffPaths(ptree, tree)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			counts[p]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for p, n := range counts {
+		if n == c.NumParents() {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// diffPaths returns the paths that differ between trees a and b.
+func diffPaths(a, b *object.Tree) ([]string, error) {
+	changes, err := object.DiffTree(a, b)
+	if err != nil {
+		return nil, fmt.Errorf("error comparing trees: %w", err)
+	}
+	seen := map[string]struct{}{}
+	var paths []string
+	for _, ch := range changes {
+		for _, name := range []string{ch.From.Name, ch.To.Name} {
+			if name == "" {
+				continue
+			}
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			paths = append(paths, name)
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,72 @@
+// Package lfsgit finds Git LFS pointers in Git repositories.
+package lfsgit
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+// MaxPointerSize is the maximum size of a Git LFS pointer file.
+const MaxPointerSize = 1024
+
+// pointerVersions are the pointer file versions understood by Git LFS.
+var pointerVersions = []string{
+	"https://git-lfs.github.com/spec/v1",
+	"https://hawser.github.com/spec/v1",
+}
+
+// DecodePointer parses the contents of a Git LFS pointer file. It reports
+// whether data is a valid pointer.
+func DecodePointer(data []byte) (transfer.Pointer, bool) {
+	var p transfer.Pointer
+	if len(data) > MaxPointerSize {
+		return p, false
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) < 3 {
+		return p, false
+	}
+	version, ok := strings.CutPrefix(lines[0], "version ")
+	if !ok || !isPointerVersion(version) {
+		return p, false
+	}
+	var hasOid, hasSize bool
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, " ")
+		if !ok {
+			return p, false
+		}
+		switch key {
+		case "oid":
+			oid, ok := strings.CutPrefix(value, "sha256:")
+			if !ok {
+				return p, false
+			}
+			p.Oid, hasOid = oid, true
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return p, false
+			}
+			p.Size, hasSize = size, true
+		}
+	}
+	return p, hasOid && hasSize && p.IsValid()
+}
+
+func isPointerVersion(v string) bool {
+	for _, pv := range pointerVersions {
+		if v == pv {
+			return true
+		}
+	}
+	return false
+}
+
+// looksLikePointer is a cheap check for data that may be a pointer file.
+func looksLikePointer(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("version "))
+}
@@ -0,0 +1,89 @@
+package lfsgit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-billy/v5/helper/mount"
+	"github.com/go-git/go-billy/v5/helper/polyfill"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// IncomingObjects returns an object storer that reads objects from s and,
+// when run from a pre-receive hook, from the directory holding the objects of
+// the push being received. Git keeps these in quarantine, away from the
+// repository's object store, until the hook accepts the push.
+func IncomingObjects(s storer.EncodedObjectStorer, gitdir string) storer.EncodedObjectStorer {
+	dir := os.Getenv("GIT_QUARANTINE_PATH")
+	if dir == "" {
+		dir = os.Getenv("GIT_OBJECT_DIRECTORY")
+	}
+	if dir == "" {
+		return s
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(gitdir, dir)
+	}
+	if filepath.Clean(dir) == filepath.Join(gitdir, "objects") {
+		return s
+	}
+	// The storage expects a git directory, so mount the quarantine as
+	// its objects directory.
+	fs := polyfill.New(mount.New(memfs.New(), "objects", osfs.New(dir)))
+	return &incomingStorer{
+		EncodedObjectStorer: s,
+		incoming:            filesystem.NewStorage(fs, cache.NewObjectLRUDefault()),
+	}
+}
+
+// shallowStorer is implemented by storers that know the shallow commits of
+// their repository, whose parents are missing on purpose.
+type shallowStorer interface {
+	Shallow() ([]plumbing.Hash, error)
+}
+
+// incomingStorer looks objects up in the incoming objects first.
+type incomingStorer struct {
+	storer.EncodedObjectStorer
+	incoming storer.EncodedObjectStorer
+}
+
+// EncodedObject implements storer.EncodedObjectStorer.
+func (s *incomingStorer) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.incoming.EncodedObject(t, h)
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return s.EncodedObjectStorer.EncodedObject(t, h)
+	}
+	return obj, err
+}
+
+// HasEncodedObject implements storer.EncodedObjectStorer.
+func (s *incomingStorer) HasEncodedObject(h plumbing.Hash) error {
+	if err := s.incoming.HasEncodedObject(h); err == nil {
+		return nil
+	}
+	return s.EncodedObjectStorer.HasEncodedObject(h)
+}
+
+// EncodedObjectSize implements storer.EncodedObjectStorer.
+func (s *incomingStorer) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	size, err := s.incoming.EncodedObjectSize(h)
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return s.EncodedObjectStorer.EncodedObjectSize(h)
+	}
+	return size, err
+}
+
+// Shallow implements shallowStorer.
+func (s *incomingStorer) Shallow() ([]plumbing.Hash, error) {
+	if ss, ok := s.EncodedObjectStorer.(shallowStorer); ok {
+		return ss.Shallow()
+	}
+	return nil, nil
+}
@@ -0,0 +1,401 @@
+package lfsgit
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// Entry is a Git LFS pointer found in a tree.
+type Entry struct {
+	transfer.Pointer
+
+	// Path is the path of the pointer file in the tree it was found in.
+	Path string
+}
+
+// Walker walks the history of a repository looking for Git LFS pointers.
+// Commits, trees and blobs are only visited once across calls.
+type Walker struct {
+	s       storer.EncodedObjectStorer
+	commits map[plumbing.Hash]struct{}
+	trees   map[plumbing.Hash]struct{}
+	blobs   map[plumbing.Hash]struct{}
+	// shallow holds the commits listed in the repository's shallow file,
+	// read the first time a parent is missing.
+	shallow map[plumbing.Hash]struct{}
+}
+
+// NewWalker creates a new walker reading objects from s.
+func NewWalker(s storer.EncodedObjectStorer) *Walker {
+	return &Walker{
+		s:       s,
+		commits: map[plumbing.Hash]struct{}{},
+		trees:   map[plumbing.Hash]struct{}{},
+		blobs:   map[plumbing.Hash]struct{}{},
+	}
+}
+
+// Hide marks the commits reachable from the given commits as already seen,
+// along with the trees and blobs of the given commits themselves. Later walks
+// then only report what isn't already part of them.
+func (w *Walker) Hide(hashes ...plumbing.Hash) error {
+	for _, h := range hashes {
+		c, err := w.peel(h)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			continue
+		}
+		if err := w.walkTree(c.TreeHash, "", nil); err != nil {
+			return err
+		}
+	}
+	return w.Commits(hashes, func(*object.Commit) error { return nil })
+}
+
+// Commits calls fn for every commit reachable from the given commits that
+// hasn't been seen yet. Tags are peeled; objects that aren't commits are
+// ignored.
+func (w *Walker) Commits(hashes []plumbing.Hash, fn func(*object.Commit) error) error {
+	var stack []*object.Commit
+	for _, h := range hashes {
+		c, err := w.peel(h)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			stack = append(stack, c)
+		}
+	}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := w.commits[c.Hash]; ok {
+			continue
+		}
+		w.commits[c.Hash] = struct{}{}
+		if err := fn(c); err != nil {
+			return err
+		}
+		for _, p := range c.ParentHashes {
+			if _, ok := w.commits[p]; ok {
+				continue
+			}
+			parent, ok, err := w.parent(c, p)
+			if err != nil {
+				return err
+			}
+			if ok {
+				stack = append(stack, parent)
+			}
+		}
+	}
+	return nil
+}
+
+// parent reads the parent p of c. It returns false if c is a shallow commit
+// whose parents were left out of the repository, and an error if p is
+// missing otherwise, as the history it leads to can't be walked.
+func (w *Walker) parent(c *object.Commit, p plumbing.Hash) (*object.Commit, bool, error) {
+	parent, err := object.GetCommit(w.s, p)
+	if err == nil {
+		return parent, true, nil
+	}
+	if !errors.Is(err, plumbing.ErrObjectNotFound) {
+		return nil, false, fmt.Errorf("error reading commit %s: %w", p, err)
+	}
+	if w.shallow == nil {
+		w.shallow = map[plumbing.Hash]struct{}{}
+		if ss, ok := w.s.(shallowStorer); ok {
+			hashes, err := ss.Shallow()
+			if err != nil {
+				return nil, false, fmt.Errorf("error reading shallow commits: %w", err)
+			}
+			for _, h := range hashes {
+				w.shallow[h] = struct{}{}
+			}
+		}
+	}
+	if _, ok := w.shallow[c.Hash]; ok {
+		return nil, false, nil
+	}
+	return nil, false, fmt.Errorf("error reading commit %s, parent of %s: %w", p, c.Hash, err)
+}
+
+// Pointers calls fn for every Git LFS pointer in the commits reachable from
+// the given commits that hasn't been seen yet.
+func (w *Walker) Pointers(hashes []plumbing.Hash, fn func(Entry) error) error {
+	return w.Commits(hashes, func(c *object.Commit) error {
+		return w.walkTree(c.TreeHash, "", fn)
+	})
+}
+
+// incomingSlop is the number of known commits Incoming keeps walking once
+// only known commits are left to visit, and none of them is newer than the
+// oldest incoming commit found, in case committer dates are skewed.
+const incomingSlop = 5
+
+// Incoming returns the commits reachable from tips but not from known, like
+// `git rev-list <tips> --not <known>`, along with the boundary: the known
+// commits they are based on. Both sides are walked newest first, and like Git,
+// the walk stops once only known commits are left to visit, all older than
+// the incoming commits found, plus a few more in case committer dates are
+// skewed. Only the history since the tips diverged from known is read. Tags
+// are peeled; objects that aren't commits are ignored.
+func (w *Walker) Incoming(tips, known []plumbing.Hash) ([]*object.Commit, []*object.Commit, error) {
+	const (
+		seen = 1 << iota
+		uninteresting
+	)
+	flags := map[plumbing.Hash]int{}
+	loaded := map[plumbing.Hash]*object.Commit{}
+	q := &commitQueue{}
+	pending := 0
+	add := func(c *object.Commit, unint bool) {
+		f := flags[c.Hash]
+		if f&seen != 0 && (!unint || f&uninteresting != 0) {
+			return
+		}
+		f |= seen
+		if unint {
+			f |= uninteresting
+		} else {
+			pending++
+		}
+		flags[c.Hash] = f
+		loaded[c.Hash] = c
+		heap.Push(q, queuedCommit{c, unint})
+	}
+	for _, side := range []struct {
+		hashes []plumbing.Hash
+		unint  bool
+	}{{known, true}, {tips, false}} {
+		for _, h := range side.hashes {
+			c, err := w.peel(h)
+			if err != nil {
+				return nil, nil, err
+			}
+			if c != nil {
+				add(c, side.unint)
+			}
+		}
+	}
+	var candidates []*object.Commit
+	var oldest time.Time
+	for slop := incomingSlop; q.Len() > 0 && slop > 0; {
+		item := heap.Pop(q).(queuedCommit)
+		if !item.unint {
+			pending--
+		}
+		if flags[item.c.Hash]&uninteresting != 0 && !item.unint {
+			// Reached from known after being queued from tips.
+			continue
+		}
+		if !item.unint {
+			candidates = append(candidates, item.c)
+			oldest = item.c.Committer.When
+		}
+		for _, p := range item.c.ParentHashes {
+			parent, ok := loaded[p]
+			if !ok {
+				var err error
+				if parent, ok, err = w.parent(item.c, p); err != nil {
+					return nil, nil, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			add(parent, item.unint)
+		}
+		switch {
+		case !item.unint:
+		case pending > 0, len(candidates) > 0 && q.Len() > 0 && !(*q)[0].c.Committer.When.Before(oldest):
+			// Known commits may still lead to the ones found.
+			slop = incomingSlop
+		default:
+			slop--
+		}
+	}
+	var commits, boundary []*object.Commit
+	inBoundary := map[plumbing.Hash]struct{}{}
+	for _, c := range candidates {
+		if flags[c.Hash]&uninteresting != 0 {
+			continue
+		}
+		commits = append(commits, c)
+		for _, p := range c.ParentHashes {
+			if _, ok := inBoundary[p]; ok || flags[p]&uninteresting == 0 {
+				continue
+			}
+			inBoundary[p] = struct{}{}
+			boundary = append(boundary, loaded[p])
+		}
+	}
+	return commits, boundary, nil
+}
+
+// PointersSince calls fn for every Git LFS pointer introduced by the commits
+// reachable from tips but not from known. Pointers already present in the
+// trees of the known commits these are based on aren't reported.
+func (w *Walker) PointersSince(tips, known []plumbing.Hash, fn func(Entry) error) error {
+	commits, boundary, err := w.Incoming(tips, known)
+	if err != nil {
+		return err
+	}
+	for _, c := range boundary {
+		if err := w.walkTree(c.TreeHash, "", nil); err != nil {
+			return err
+		}
+	}
+	for _, c := range commits {
+		if err := w.walkTree(c.TreeHash, "", fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queuedCommit is a commit waiting to be visited by Incoming.
+type queuedCommit struct {
+	c     *object.Commit
+	unint bool
+}
+
+// commitQueue is a heap of commits, newest committed first.
+type commitQueue []queuedCommit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].c.Committer.When.After(q[j].c.Committer.When)
+}
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)   { *q = append(*q, x.(queuedCommit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// blobPointer returns the pointer stored in the given blob, if any.
+func (w *Walker) blobPointer(h plumbing.Hash) (transfer.Pointer, bool, error) {
+	size, err := w.s.EncodedObjectSize(h)
+	if err != nil {
+		return transfer.Pointer{}, false, err
+	}
+	if size > MaxPointerSize {
+		return transfer.Pointer{}, false, nil
+	}
+	blob, err := object.GetBlob(w.s, h)
+	if err != nil {
+		return transfer.Pointer{}, false, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return transfer.Pointer{}, false, err
+	}
+	defer r.Close() // nolint: errcheck
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return transfer.Pointer{}, false, err
+	}
+	if !looksLikePointer(data) {
+		return transfer.Pointer{}, false, nil
+	}
+	p, ok := DecodePointer(data)
+	return p, ok, nil
+}
+
+// walkTree visits the tree h and its subtrees, calling fn, if not nil, for
+// every pointer not seen yet.
+func (w *Walker) walkTree(h plumbing.Hash, dir string, fn func(Entry) error) error {
+	if _, ok := w.trees[h]; ok {
+		return nil
+	}
+	w.trees[h] = struct{}{}
+	tree, err := object.GetTree(w.s, h)
+	if err != nil {
+		return fmt.Errorf("error reading tree %s: %w", h, err)
+	}
+	for _, e := range tree.Entries {
+		p := path.Join(dir, e.Name)
+		switch e.Mode {
+		case filemode.Dir:
+			if err := w.walkTree(e.Hash, p, fn); err != nil {
+				return err
+			}
+		case filemode.Regular, filemode.Executable, filemode.Deprecated:
+			if _, ok := w.blobs[e.Hash]; ok {
+				continue
+			}
+			w.blobs[e.Hash] = struct{}{}
+			if fn == nil {
+				continue
+			}
+			ptr, ok, err := w.blobPointer(e.Hash)
+			if err != nil {
+				return fmt.Errorf("error reading blob %s: %w", e.Hash, err)
+			}
+			if !ok {
+				continue
+			}
+			if err := fn(Entry{Pointer: ptr, Path: p}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// peel resolves h to a commit, following annotated tags. It returns nil if h
+// doesn't point to a commit.
+func (w *Walker) peel(h plumbing.Hash) (*object.Commit, error) {
+	for {
+		obj, err := w.s.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, fmt.Errorf("error reading object %s: %w", h, err)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			return object.DecodeCommit(w.s, obj)
+		case plumbing.TagObject:
+			tag, err := object.DecodeTag(w.s, obj)
+			if err != nil {
+				return nil, err
+			}
+			h = tag.Target
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// RefHashes returns the hashes the references of a repository point to.
+// Symbolic references are skipped, since they point to other references.
+func RefHashes(s storer.ReferenceStorer) ([]plumbing.Hash, error) {
+	iter, err := s.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	var hashes []plumbing.Hash
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			hashes = append(hashes, ref.Hash())
+		}
+		return nil
+	})
+	return hashes, err
+}
@@ -0,0 +1,121 @@
+package local
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// alternatesFile is the path, relative to an objects directory, of the list
+// of other object stores to look objects up in.
+var alternatesFile = filepath.Join("info", "alternates")
+
+// readAlternates reads the alternate objects directories listed in the
+// alternates file of objectsDir. Like Git's object alternates, each line names
+// an objects directory, relative paths are relative to objectsDir, and blank
+// lines and lines starting with "#" are ignored.
+func readAlternates(objectsDir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(objectsDir, alternatesFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	var dirs []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(objectsDir, line)
+		}
+		dirs = append(dirs, filepath.Clean(line))
+	}
+	return dirs, s.Err()
+}
+
+// linkIntoPool deduplicates the object stored at path against the shared
+// pool. If the pool already has a good copy of the object, the repository's
+// copy is replaced by a link to it; otherwise the object is linked into the
+// pool, taking the place of a corrupt copy. The link is touched, as the pool's
+// copy may be older than the grace period protecting new uploads from gc.
+func (l *LocalBackend) linkIntoPool(oid, path string) error {
+	_, ext := splitCompressionExt(path)
+	poolPath, err := l.objectPath(l.sharedPool, oid)
+	if err != nil {
+		return err
+	}
+	poolPath += ext
+	if l.poolCopyIsGood(oid, path, poolPath) {
+		if err := replaceWithLink(poolPath, path); err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); err != nil {
+			return err
+		}
+		return l.MarkVerified(oid)
+	}
+	if err := os.MkdirAll(filepath.Dir(poolPath), 0777); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(poolPath); err == nil {
+		l.logger.Log("replacing corrupt object in shared pool", "oid", oid, "path", poolPath)
+		return replaceWithLink(path, poolPath)
+	}
+	if err := os.Link(path, poolPath); err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("error linking object into shared pool: %w", err)
+	}
+	return nil
+}
+
+// poolCopyIsGood reports whether the shared pool holds a copy of oid at
+// poolPath whose contents match oid. The copy is only hashed if it has the
+// size of the upload stored at path, isn't already the same file, and wasn't
+// verified recently.
+func (l *LocalBackend) poolCopyIsGood(oid, path, poolPath string) bool {
+	poolObj, err := objectAt(poolPath)
+	if err != nil || poolObj.torn {
+		return false
+	}
+	obj, err := objectAt(path)
+	if err != nil || obj.size != poolObj.size {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	poolInfo, err := os.Stat(poolPath)
+	if err != nil {
+		return false
+	}
+	if os.SameFile(info, poolInfo) || l.verifiedSince(oid, poolInfo) {
+		return true
+	}
+	actual, _, err := hashObject(poolObj, nil)
+	return err == nil && actual == oid
+}
+
+// replaceWithLink atomically replaces dest with a hard link to src.
+func replaceWithLink(src, dest string) error {
+	tempFile := dest + ".pool"
+	os.Remove(tempFile) // nolint: errcheck
+	if err := os.Link(src, tempFile); err != nil {
+		return fmt.Errorf("error linking object with shared pool: %w", err)
+	}
+	if err := os.Rename(tempFile, dest); err != nil {
+		os.Remove(tempFile) // nolint: errcheck
+		return fmt.Errorf("error linking object with shared pool: %w", err)
+	}
+	return nil
+}
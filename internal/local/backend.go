@@ -18,55 +18,168 @@ import (
 
 var _ transfer.Backend = &LocalBackend{}
 
-func oidExpectedPath(root, oid string) string {
-	p := transfer.Pointer{Oid: oid}
-	rp := p.RelativePath()
+func layoutPath(objectsDir string, layout Layout, oid string) (string, error) {
+	rp, ok := layout.Path(oid)
+	if !ok {
+		return "", invalidOidError(oid)
+	}
 	rp = strings.ReplaceAll(rp, "/", string(filepath.Separator))
-	return filepath.Join(root, "objects", rp)
+	return filepath.Join(objectsDir, rp), nil
 }
 
 // LocalBackend is a local Git LFS backend.
 type LocalBackend struct { // nolint: revive
-	timestamp *time.Time
-	lfsPath   string
-	umask     fs.FileMode
+	timestamp          *time.Time
+	lfsPath            string
+	umask              fs.FileMode
+	compression        string
+	compressionMinSize int64
+	alternates         []string
+	sharedPool         string
+	layout             Layout
+	previousLayouts    []Layout
+	maxTotal           int64
+	maxObject          int64
+	minFreeSpace       int64
+	fsync              string
+	quarantine         string
+	allQuarantines     bool
+	verifiedTTL        time.Duration
+	deepVerify         bool
+	lockOwner          string
+	scanners           []transfer.Scanner
+	logger             transfer.Logger
+}
+
+// Option is a local backend option.
+type Option func(*LocalBackend)
+
+// WithCompression compresses uploaded objects at rest using the given
+// algorithm. Objects smaller than minSize, or whose content looks already
+// compressed, are stored as-is.
+func WithCompression(algo string, minSize int64) Option {
+	return func(l *LocalBackend) {
+		l.compression = algo
+		l.compressionMinSize = minSize
+	}
+}
+
+// WithSharedPool hardlinks uploaded objects into the objects directory at
+// path, shared by several repositories. Objects already in the pool are
+// deduplicated by linking the pool's copy into the repository instead.
+func WithSharedPool(path string) Option {
+	return func(l *LocalBackend) {
+		l.sharedPool = path
+	}
 }
 
 // New creates a new local backend. lfsPath should be a `.git/lfs` directory.
-func New(lfsPath string, umask os.FileMode, timestamp *time.Time) *LocalBackend {
-	return &LocalBackend{
-		lfsPath:   lfsPath,
-		umask:     umask,
-		timestamp: timestamp,
+// Objects missing from the repository are looked up in the object stores
+// listed in `objects/info/alternates`.
+func New(lfsPath string, umask os.FileMode, timestamp *time.Time, opts ...Option) *LocalBackend {
+	l := &LocalBackend{
+		lfsPath:     lfsPath,
+		umask:       umask,
+		timestamp:   timestamp,
+		compression: CompressionNone,
+		layout:      DefaultLayout,
+		logger:      transfer.NopLogger(),
+		fsync:       FsyncNone,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	alternates, err := readAlternates(l.objectsDir())
+	if err != nil {
+		l.logger.Log("error reading alternates, ignoring them", "err", err)
 	}
+	for _, dir := range alternates {
+		if _, err := os.Stat(dir); err != nil {
+			l.logger.Log("unusable alternate", "dir", dir, "err", err)
+		}
+	}
+	l.alternates = alternates
+	return l
+}
+
+// objectsDir returns the repository's objects directory.
+func (l *LocalBackend) objectsDir() string {
+	return filepath.Join(l.lfsPath, "objects")
+}
+
+// objectPath returns the path of an object in the given objects directory.
+func (l *LocalBackend) objectPath(objectsDir, oid string) (string, error) {
+	return layoutPath(objectsDir, l.layout, oid)
 }
 
-// Batch implements main.Backend.
-func (l *LocalBackend) Batch(_ string, pointers []transfer.BatchItem, _ transfer.Args) ([]transfer.BatchItem, error) {
+// Batch implements main.Backend. Upload batches that don't fit in the
+// quotas are refused with an error wrapping transfer.ErrTooLarge, and those
+// that don't fit on disk with one wrapping transfer.ErrInsufficientStorage.
+func (l *LocalBackend) Batch(op string, pointers []transfer.BatchItem, _ transfer.Args) ([]transfer.BatchItem, error) {
 	for i := range pointers {
+		if !validOid(pointers[i].Oid) {
+			return nil, invalidOidError(pointers[i].Oid)
+		}
 		present := false
-		stat, err := os.Stat(oidExpectedPath(l.lfsPath, pointers[i].Oid))
+		stat := l.stat
+		if op == transfer.UploadOperation {
+			stat = l.statUploaded
+		}
+		obj, err := stat(pointers[i].Oid)
+		if err == nil && isTorn(pointers[i].Oid, obj) {
+			// Removed when the object is uploaded again.
+			err = fs.ErrNotExist
+		}
 		if err == nil {
-			pointers[i].Size = stat.Size()
+			pointers[i].Size = obj.size
 			present = true
 		}
 		pointers[i].Present = present
 	}
+	if op == transfer.UploadOperation {
+		if err := l.checkBatch(pointers); err != nil {
+			return nil, err
+		}
+		var incoming int64
+		for _, p := range pointers {
+			if !p.Present {
+				incoming += p.Size
+			}
+		}
+		if incoming > 0 {
+			if err := l.checkFreeSpace(incoming); err != nil {
+				return nil, err
+			}
+		}
+	}
 	return pointers, nil
 }
 
+// StatObject implements transfer.ObjectStater. Like a batch request of an
+// upload, it finds quarantined objects, but doesn't check quotas or free
+// space.
+func (l *LocalBackend) StatObject(oid string) (int64, error) {
+	if !validOid(oid) {
+		return 0, invalidOidError(oid)
+	}
+	obj, err := l.statUploaded(oid)
+	if err != nil {
+		return 0, err
+	}
+	if isTorn(oid, obj) {
+		return 0, &fs.PathError{Op: "stat", Path: oid, Err: fs.ErrNotExist}
+	}
+	return obj.size, nil
+}
+
 // Download implements main.Backend. The returned reader must be closed by the
 // caller.
 func (l *LocalBackend) Download(oid string, _ transfer.Args) (io.ReadCloser, int64, error) {
-	f, err := os.Open(oidExpectedPath(l.lfsPath, oid))
-	if err != nil {
-		return nil, 0, err
-	}
-	info, err := f.Stat()
+	obj, err := l.stat(oid)
 	if err != nil {
 		return nil, 0, err
 	}
-	return f, info.Size(), nil
+	return obj.open()
 }
 
 // LockBackend implements main.Backend.
@@ -75,11 +188,40 @@ func (l *LocalBackend) LockBackend(_ transfer.Args) transfer.LockBackend {
 	return NewLockBackend(l, path)
 }
 
-// Upload implements main.Backend.
+// Upload implements main.Backend. Concurrent uploads of the same object are
+// serialized, and uploading an object that is already stored with the right
+// size only verifies the data without writing it again.
 func (l *LocalBackend) Upload(oid string, size int64, r io.Reader, _ transfer.Args) error {
 	if r == nil {
 		return fmt.Errorf("%w: received null data", transfer.ErrMissingData)
 	}
+	if !validOid(oid) {
+		return invalidOidError(oid)
+	}
+	release, err := l.lockOid(oid)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if l.stored(oid, size) {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	if err := l.removeTorn(oid); err != nil {
+		return err
+	}
+	r, err = l.limitUpload(oid, size, r)
+	if err != nil {
+		return err
+	}
+	if err := l.checkFreeSpace(size); err != nil {
+		return err
+	}
+	releaseSession, err := l.lockSession()
+	if err != nil {
+		return err
+	}
+	defer releaseSession()
 	tempDir := filepath.Join(l.lfsPath, "incomplete")
 	randBytes := make([]byte, 12)
 	if _, err := rand.Read(randBytes); err != nil {
@@ -95,39 +237,91 @@ func (l *LocalBackend) Upload(oid string, size int64, r io.Reader, _ transfer.Ar
 		f.Close()
 		os.Remove(tempFile)
 	}()
-	if _, err := io.Copy(f, r); err != nil {
+	written, err := io.Copy(f, r)
+	if err != nil {
+		return l.noSpace(err)
+	}
+	if err := l.syncFile(f); err != nil {
 		return err
 	}
 	f.Close() // double-close is fine
-	destPath := oidExpectedPath(l.lfsPath, oid)
-	parent := filepath.Dir(destPath)
-	if err := os.MkdirAll(parent, 0777); err != nil {
+	if err := l.scan(oid, tempFile); err != nil {
+		return err
+	}
+	destPath, err := l.objectPath(l.uploadDir(), oid)
+	if err != nil {
+		return err
+	}
+	srcPath := tempFile
+	if l.compression != CompressionNone {
+		ok, err := shouldCompress(tempFile, written, l.compressionMinSize)
+		if err != nil {
+			return err
+		}
+		if ok {
+			ext := compressionExts[l.compression]
+			compressed := tempFile + ext
+			defer os.Remove(compressed) // nolint: errcheck
+			n, err := compressFile(compressed, tempFile, l.compression, written, l.syncFile)
+			if err != nil {
+				return fmt.Errorf("error compressing object: %w", err)
+			}
+			// Only keep the compressed copy if it saves at least 10%.
+			if n < written-written/10 {
+				srcPath, destPath = compressed, destPath+ext
+			}
+		}
+	}
+	if err := l.storeObject(srcPath, destPath); err != nil {
+		if errors.Is(err, fs.ErrExist) && l.stored(oid, written) {
+			// Stored by a writer we couldn't coordinate with.
+			return nil
+		}
 		return err
 	}
-	if err := os.Link(tempFile, destPath); err != nil {
+	if err := l.syncDirs(destPath, l.uploadDir()); err != nil {
 		return err
 	}
 	if _, err := l.FixPermissions(destPath); err != nil {
 		return err
 	}
+	if l.sharedPool != "" && l.quarantine == "" {
+		return l.linkIntoPool(oid, destPath)
+	}
 	return nil
 }
 
-// Verify implements main.Backend.
+// stored reports whether oid is already stored in the repository's objects
+// directory or the session's upload quarantine with the given size.
+func (l *LocalBackend) stored(oid string, size int64) bool {
+	for _, dir := range l.storeDirs() {
+		obj, err := l.statIn(dir, oid)
+		if err == nil && !obj.torn && obj.size == size && (size > 0 || oid == emptyOid) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify implements main.Backend. The contents of the object are hashed too
+// with deep verification, or when the request has the verify=deep argument.
 func (l *LocalBackend) Verify(oid string, size int64, args transfer.Args) (transfer.Status, error) {
 	if size == 0 {
 		return nil, fmt.Errorf("missing size argument")
 	}
-	stat, err := os.Stat(oidExpectedPath(l.lfsPath, oid))
+	obj, err := l.statUploaded(oid)
 	if errors.Is(err, fs.ErrNotExist) {
 		return transfer.NewStatus(transfer.StatusNotFound, "not found"), nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	if stat.Size() != size {
+	if obj.size != size {
 		return transfer.NewStatus(transfer.StatusConflict, "size mismatch"), nil
 	}
+	if l.deepVerify || args[transfer.VerifyKey] == transfer.VerifyDeep {
+		return l.verifyContents(oid, obj)
+	}
 	return transfer.SuccessStatus(), nil
 }
 
@@ -151,12 +345,30 @@ func (l *localLockBackend) Timestamp() *time.Time {
 	return l.backend.(*LocalBackend).timestamp
 }
 
+// owner returns the name recorded as the owner of the locks created, or an
+// empty string if it's the system user owning the lock files.
+func (l *localLockBackend) owner() string {
+	return l.backend.(*LocalBackend).lockOwner
+}
+
+// newLock returns the lock of path owned by ownerName.
+func (l *localLockBackend) newLock(path string, time *time.Time, ownerName string) transfer.Lock {
+	lock := NewLocalBackendLock(l.lockPath, path, time, ownerName).(*localBackendLock)
+	lock.user = l.owner()
+	return lock
+}
+
 // Create implements main.LockBackend.
 func (l *localLockBackend) Create(path, _ string) (transfer.Lock, error) {
 	id := localBackendLock{}.HashFor(path)
 	var b bytes.Buffer
 	b.WriteString(fmt.Sprintf("%s:%d:", LocalBackendLockVersion, l.Timestamp().Unix()))
 	b.WriteString(path)
+	if owner := l.owner(); owner != "" {
+		// Paths can't contain NUL bytes.
+		b.WriteByte(0)
+		b.WriteString(owner)
+	}
 	fileName := filepath.Join(l.lockPath, id)
 	f, err := NewLockFile(fileName)
 	if err != nil {
@@ -172,11 +384,14 @@ func (l *localLockBackend) Create(path, _ string) (transfer.Lock, error) {
 	if err := f.Persist(); err != nil {
 		return nil, err
 	}
-	user, err := l.UserForFile(fileName)
-	if err != nil {
-		return nil, err
+	user := l.owner()
+	if user == "" {
+		user, err = l.UserForFile(fileName)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return NewLocalBackendLock(l.lockPath, path, l.Timestamp(), user), nil
+	return l.newLock(path, l.Timestamp(), user), nil
 }
 
 // FromID implements main.LockBackend.
@@ -195,11 +410,15 @@ func (l *localLockBackend) FromID(id string) (transfer.Lock, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing local lock file: %w", err)
 	}
-	user, err := l.UserForFile(fileName)
-	if err != nil {
-		return nil, fmt.Errorf("error getting user for local lock file: %w", err)
+	btsPath, owner, hasOwner := bytes.Cut(btsPath, []byte{0})
+	user := string(owner)
+	if !hasOwner {
+		user, err = l.UserForFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("error getting user for local lock file: %w", err)
+		}
 	}
-	return NewLocalBackendLock(l.lockPath, string(btsPath), time, user), nil
+	return l.newLock(string(btsPath), time, user), nil
 }
 
 // FromPath implements main.LockBackend.
@@ -221,8 +440,10 @@ func (localLockBackend) Unlock(lock transfer.Lock) error {
 }
 
 // Range implements main.LockBackend. Iterate over all locks. Returning an error will break and return.
+// Locks being written, and locks removed while iterating, are skipped. So are
+// locks that can't be read, which are logged, so that one corrupt lock
+// doesn't break listing the others.
 func (l *localLockBackend) Range(_ string, _ int, f func(l transfer.Lock) error) (string, error) {
-	var err error
 	data, err := os.ReadDir(l.lockPath)
 	if err != nil {
 		return "", err
@@ -231,14 +452,20 @@ func (l *localLockBackend) Range(_ string, _ int, f func(l transfer.Lock) error)
 		return data[i].Name() < data[j].Name()
 	})
 	for _, lf := range data {
-		var lock transfer.Lock
-		lock, err = l.FromID(lf.Name())
+		if strings.HasSuffix(lf.Name(), ".lock") {
+			continue
+		}
+		lock, err := l.FromID(lf.Name())
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
 		if err != nil {
-			err = errors.Join(err, fmt.Errorf("error reading lock %s: %w", lf.Name(), err))
+			l.backend.(*LocalBackend).logger.Log("skipping unreadable lock", "id", lf.Name(), "err", err)
+			continue
 		}
 		if err := f(lock); err != nil {
 			return "", err
 		}
 	}
-	return "", err
+	return "", nil
 }
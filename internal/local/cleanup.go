@@ -0,0 +1,125 @@
+package local
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/flock"
+)
+
+// CleanupOptions are the options of Cleanup.
+type CleanupOptions struct {
+	// Age is how long temporary upload files must have been left untouched
+	// to be removed.
+	Age time.Duration
+	// DryRun reports the files that would be removed without removing them.
+	DryRun bool
+}
+
+// Cleanup removes the temporary files left behind by processes that were
+// killed: upload files in `lfs/incomplete` untouched for opts.Age, upload
+// locks no process holds, and lock files under `lfs/locks` older than
+// StaleLockAge. report is called for every file removed.
+func (l *LocalBackend) Cleanup(opts CleanupOptions, report func(path string, size int64) error) error {
+	remove := func(path string) (bool, error) {
+		if opts.DryRun {
+			return true, nil
+		}
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	err := l.cleanupDir(filepath.Join(l.lfsPath, "incomplete"), func(path string, info fs.FileInfo) (bool, error) {
+		if strings.HasSuffix(path, ".lock") {
+			if l.timestamp.Sub(info.ModTime()) < StaleLockAge {
+				return false, nil
+			}
+			return removeUnheld(path, opts.DryRun)
+		}
+		if l.timestamp.Sub(info.ModTime()) < opts.Age {
+			return false, nil
+		}
+		return remove(path)
+	}, report)
+	if err != nil {
+		return err
+	}
+	return l.cleanupDir(filepath.Join(l.lfsPath, "locks"), func(path string, info fs.FileInfo) (bool, error) {
+		if !strings.HasSuffix(path, ".lock") || l.timestamp.Sub(info.ModTime()) < StaleLockAge {
+			return false, nil
+		}
+		if opts.DryRun {
+			return true, nil
+		}
+		return removeStale(path, StaleLockAge), nil
+	}, report)
+}
+
+// cleanupDir calls remove for every regular file of dir, and report for
+// those it removed.
+func (l *LocalBackend) cleanupDir(dir string, remove func(path string, info fs.FileInfo) (bool, error), report func(string, int64) error) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		removed, err := remove(path, info)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			continue
+		}
+		l.logger.Log("stale temporary file", "path", path, "size", info.Size())
+		if err := report(path, info.Size()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeUnheld removes the upload lock at path if no process holds it. The
+// file is removed while locked, so that processes waiting for it notice and
+// start over, as lockOid does.
+func removeUnheld(path string, dryRun bool) (bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close() // nolint: errcheck
+	ok, err := flock.TryLock(f)
+	if err != nil || !ok {
+		return false, err
+	}
+	defer flock.Unlock(f) // nolint: errcheck
+	locked, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(path)
+	if err != nil || !os.SameFile(locked, current) {
+		// Released and removed by its holder meanwhile.
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+	return true, os.Remove(path)
+}
@@ -0,0 +1,192 @@
+package local
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms supported by the local backend.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// compressionExts maps compression algorithms to the file name suffix that
+// marks a compressed object on disk.
+var compressionExts = map[string]string{
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+// compressedHeaderSize is the size of the header preceding the compressed
+// stream. It holds the logical, uncompressed size of the object.
+const compressedHeaderSize = 8
+
+// incompressibleTypes are content types that are already compressed and not
+// worth compressing again.
+var incompressibleTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/x-rar-compressed",
+	"application/pdf",
+	"application/wasm",
+	"audio/",
+	"font/woff",
+	"image/gif",
+	"image/jpeg",
+	"image/png",
+	"image/webp",
+	"video/",
+}
+
+// ParseCompression validates the given compression algorithm name.
+func ParseCompression(algo string) (string, error) {
+	switch algo {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip, CompressionZstd:
+		return algo, nil
+	default:
+		return "", fmt.Errorf("unknown compression algorithm %q", algo)
+	}
+}
+
+// shouldCompress reports whether the file at path is worth compressing based
+// on its size and content.
+func shouldCompress(path string, size, minSize int64) (bool, error) {
+	if size < minSize || size <= compressedHeaderSize {
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close() // nolint: errcheck
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	ct := http.DetectContentType(buf[:n])
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(ct, t) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// compressFile compresses src into dst using the given algorithm, and calls
+// sync on dst once written. It returns the number of bytes written to dst.
+func compressFile(dst, src string, algo string, size int64, sync func(*os.File) error) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close() // nolint: errcheck
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close() // nolint: errcheck
+	var header [compressedHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:], uint64(size))
+	if _, err := out.Write(header[:]); err != nil {
+		return 0, err
+	}
+	var w io.WriteCloser
+	switch algo {
+	case CompressionGzip:
+		w = gzip.NewWriter(out)
+	case CompressionZstd:
+		w, err = zstd.NewWriter(out)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unknown compression algorithm %q", algo)
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	if err := sync(out); err != nil {
+		return 0, err
+	}
+	info, err := out.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), out.Close()
+}
+
+// readLogicalSize returns the uncompressed size recorded in the header of a
+// compressed object.
+func readLogicalSize(r io.Reader) (int64, error) {
+	var header [compressedHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, fmt.Errorf("error reading compressed object header: %w", err)
+	}
+	return int64(binary.BigEndian.Uint64(header[:])), nil
+}
+
+// decompressReader wraps a compressed object file and closes both the
+// decompressor and the file.
+type decompressReader struct {
+	io.Reader
+	close func()
+	f     *os.File
+}
+
+// Close implements io.Closer.
+func (d *decompressReader) Close() error {
+	d.close()
+	return d.f.Close()
+}
+
+// openCompressed opens a compressed object at path and returns a reader of the
+// uncompressed contents along with the logical size.
+func openCompressed(path string, algo string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := readLogicalSize(f)
+	if err != nil {
+		f.Close() // nolint: errcheck
+		return nil, 0, err
+	}
+	switch algo {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close() // nolint: errcheck
+			return nil, 0, err
+		}
+		closeFn := func() {
+			zr.Close() // nolint: errcheck
+		}
+		return &decompressReader{Reader: zr, close: closeFn, f: f}, size, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close() // nolint: errcheck
+			return nil, 0, err
+		}
+		return &decompressReader{Reader: zr, close: zr.Close, f: f}, size, nil
+	default:
+		f.Close() // nolint: errcheck
+		return nil, 0, fmt.Errorf("unknown compression algorithm %q", algo)
+	}
+}
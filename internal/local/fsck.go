@@ -0,0 +1,261 @@
+package local
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/throttle"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+// Kinds of problems found by Fsck.
+const (
+	// ProblemCorrupt is an object whose contents don't match its ID.
+	ProblemCorrupt = "corrupt"
+	// ProblemTruncated is an object whose contents end early.
+	ProblemTruncated = "truncated"
+	// ProblemMisplaced is a file that isn't at a valid object path.
+	ProblemMisplaced = "misplaced"
+	// ProblemStaleTemp is a leftover temporary upload file.
+	ProblemStaleTemp = "stale-temp"
+)
+
+// emptyOid is the object ID of empty content.
+const emptyOid = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Problem is a problem found by Fsck.
+type Problem struct {
+	// Kind is the kind of problem.
+	Kind string `json:"type"`
+	// Oid is the ID the object is stored as, if any.
+	Oid string `json:"oid,omitempty"`
+	// Path is the path of the file.
+	Path string `json:"path"`
+	// Size is the size of the file on disk.
+	Size int64 `json:"size"`
+	// Actual is the ID of the object's actual contents, if they could be
+	// read.
+	Actual string `json:"actual,omitempty"`
+	// Message describes the problem.
+	Message string `json:"message,omitempty"`
+	// Quarantined is where the file was moved to, if it was.
+	Quarantined string `json:"quarantined,omitempty"`
+	// Removed is set when the file was deleted.
+	Removed bool `json:"removed,omitempty"`
+	// Repaired names the replica a good copy of the object was restored
+	// from, if it was.
+	Repaired string `json:"repaired,omitempty"`
+}
+
+// FsckOptions are the options of Fsck.
+type FsckOptions struct {
+	// StaleAge is the age after which temporary upload files are reported.
+	StaleAge time.Duration
+	// Quarantine moves bad objects out of the store into `lfs/corrupt`.
+	Quarantine bool
+	// RemoveTorn deletes truncated objects, such as those torn by a crash,
+	// so that they can be uploaded again. It takes precedence over
+	// Quarantine for them.
+	RemoveTorn bool
+}
+
+// Fsck re-hashes every object stored in the repository and looks for
+// leftover temporary files. report is called for every problem found. It
+// returns the number of objects checked.
+func (l *LocalBackend) Fsck(opts FsckOptions, report func(Problem) error) (int, error) {
+	checked := 0
+	err := l.walkObjects(func(oid, path string, info fs.FileInfo) error {
+		checked++
+		p := l.checkObject(oid, path, info, nil)
+		if p == nil {
+			return nil
+		}
+		switch {
+		case opts.RemoveTorn && p.Kind == ProblemTruncated && oid != "":
+			removed, err := l.removeTruncated(oid, path, info)
+			if err != nil {
+				return err
+			}
+			p.Removed = removed
+		case opts.Quarantine:
+			dest, err := l.quarantineUnchanged(p.Oid, path, info)
+			if err != nil {
+				return err
+			}
+			p.Quarantined = dest
+		}
+		return report(*p)
+	})
+	if err != nil {
+		return checked, err
+	}
+	cutoff := l.timestamp.Add(-opts.StaleAge)
+	entries, err := os.ReadDir(filepath.Join(l.lfsPath, "incomplete"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return checked, err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if !info.Mode().IsRegular() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		err = report(Problem{
+			Kind:    ProblemStaleTemp,
+			Path:    filepath.Join(l.lfsPath, "incomplete", e.Name()),
+			Size:    info.Size(),
+			Message: fmt.Sprintf("temporary file last modified %s", info.ModTime().UTC().Format(time.RFC3339)),
+		})
+		if err != nil {
+			return checked, err
+		}
+	}
+	return checked, nil
+}
+
+// checkObject checks the object stored at path as oid, which is empty if the
+// path isn't a valid object path. Reading the object is throttled by limit,
+// if not nil. It returns nil if the object is fine.
+func (l *LocalBackend) checkObject(oid, path string, info fs.FileInfo, limit *throttle.Bucket) *Problem {
+	base, ext := splitCompressionExt(filepath.Base(path))
+	compression := CompressionNone
+	for algo, e := range compressionExts {
+		if e == ext && ext != "" {
+			compression = algo
+		}
+	}
+	p := &Problem{Oid: oid, Path: path, Size: info.Size()}
+	if oid == "" {
+		p.Kind = ProblemMisplaced
+		p.Message = "not at a valid object path"
+		if validOid(base) {
+			p.Oid = base
+		}
+	}
+	obj := &object{path: path, compression: compression}
+	actual, size, err := hashObject(obj, limit)
+	p.Actual = actual
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		p.Kind = ProblemTruncated
+		p.Message = err.Error()
+	case err != nil:
+		p.Kind = ProblemCorrupt
+		p.Message = err.Error()
+	case p.Kind == ProblemMisplaced:
+	case size == 0 && oid != emptyOid:
+		p.Kind = ProblemTruncated
+		p.Message = "empty object"
+	case actual != oid:
+		p.Kind = ProblemCorrupt
+		p.Message = "object ID mismatch"
+	default:
+		return nil
+	}
+	return p
+}
+
+// hashObject hashes the contents of an object. For compressed objects, it
+// checks the contents match the size recorded in the header. Reading is
+// throttled by limit, if not nil.
+func hashObject(obj *object, limit *throttle.Bucket) (string, int64, error) {
+	r, size, err := obj.open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close() // nolint: errcheck
+	hr := transfer.NewHashingReader(throttle.NewReader(r, limit), sha256.New())
+	if _, err := io.Copy(io.Discard, hr); err != nil {
+		return "", hr.Size(), err
+	}
+	switch {
+	case hr.Size() < size:
+		return hr.Oid(), hr.Size(), fmt.Errorf("%w: expected %d bytes, got %d", io.ErrUnexpectedEOF, size, hr.Size())
+	case hr.Size() > size:
+		return hr.Oid(), hr.Size(), fmt.Errorf("%w: expected %d bytes, got %d", transfer.ErrCorruptData, size, hr.Size())
+	}
+	return hr.Oid(), hr.Size(), nil
+}
+
+// removeTruncated removes the truncated object oid found at path, unless an
+// upload replaced it since it was checked. It reports whether it did.
+func (l *LocalBackend) removeTruncated(oid, path string, info fs.FileInfo) (bool, error) {
+	release, err := l.lockOid(oid)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	cur, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !os.SameFile(cur, info)) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	return true, l.adjustUsage(-info.Size())
+}
+
+// quarantineUnchanged moves the bad object oid found at path out of the store
+// into `lfs/corrupt`, unless an upload replaced it since it was checked. oid
+// is empty if the file isn't named after an object. It returns where the
+// object was moved to, or an empty string if it wasn't.
+func (l *LocalBackend) quarantineUnchanged(oid, path string, info fs.FileInfo) (string, error) {
+	if oid != "" {
+		release, err := l.lockOid(oid)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+	}
+	cur, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !os.SameFile(cur, info)) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	dest, err := l.quarantineFile(path)
+	if err != nil {
+		return "", err
+	}
+	return dest, l.adjustUsage(-info.Size())
+}
+
+// quarantineFile moves a bad object out of the store into `lfs/corrupt`. The
+// caller holds the object's upload lock.
+func (l *LocalBackend) quarantineFile(path string) (string, error) {
+	dest, err := l.corruptPath(path)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return "", fmt.Errorf("error quarantining %s: %w", path, err)
+	}
+	return dest, nil
+}
+
+// corruptPath returns the path under `lfs/corrupt` a bad object stored at
+// path is moved to, creating the directory if needed.
+func (l *LocalBackend) corruptPath(path string) (string, error) {
+	dir := filepath.Join(l.lfsPath, "corrupt")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(l.objectsDir(), path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, strings.ReplaceAll(rel, string(filepath.Separator), "-")), nil
+}
@@ -0,0 +1,121 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Durability modes of uploads.
+const (
+	// FsyncNone leaves flushing uploads to disk to the operating system.
+	FsyncNone = "none"
+	// FsyncFile flushes the contents of uploaded objects to disk before
+	// making them visible.
+	FsyncFile = "file"
+	// FsyncFull also flushes the directory entries of uploaded objects, so
+	// that they survive a power loss once the upload is acknowledged.
+	FsyncFull = "full"
+)
+
+// ParseFsync validates the given durability mode.
+func ParseFsync(mode string) (string, error) {
+	switch mode {
+	case "":
+		return FsyncNone, nil
+	case FsyncNone, FsyncFile, FsyncFull:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown fsync mode %q", mode)
+	}
+}
+
+// WithFsync sets the durability mode of uploads.
+func WithFsync(mode string) Option {
+	return func(l *LocalBackend) {
+		l.fsync = mode
+	}
+}
+
+// syncFile flushes the contents of f to disk, unless fsync is disabled.
+func (l *LocalBackend) syncFile(f *os.File) error {
+	if l.fsync == FsyncNone {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing %s: %w", f.Name(), err)
+	}
+	return nil
+}
+
+// syncDirs flushes the directory entries leading to path, from its parent up
+// to and including root, in full durability mode.
+func (l *LocalBackend) syncDirs(path, root string) error {
+	if l.fsync != FsyncFull || runtime.GOOS == "windows" {
+		// Directories can't be synced on Windows.
+		return nil
+	}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+		if dir == root || !strings.HasPrefix(dir, root) || dir == filepath.Dir(dir) {
+			return nil
+		}
+	}
+}
+
+// syncDir flushes the entries of the directory dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close() // nolint: errcheck
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("error syncing %s: %w", dir, err)
+	}
+	return nil
+}
+
+// isTorn reports whether obj, found as oid, was torn by a crash: its
+// directory entry made it to disk but not its contents.
+func isTorn(oid string, obj *object) bool {
+	return obj.torn || (obj.compression == CompressionNone && obj.size == 0 && oid != emptyOid)
+}
+
+// removeTorn removes the torn copies of oid from the repository's objects
+// directory and the session's upload quarantine, so that it can be uploaded
+// again. The caller must hold the upload lock of oid.
+func (l *LocalBackend) removeTorn(oid string) error {
+	for _, dir := range l.storeDirs() {
+		for {
+			obj, err := l.statIn(dir, oid)
+			if errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if !isTorn(oid, obj) {
+				break
+			}
+			info, err := os.Stat(obj.path)
+			if err != nil {
+				return err
+			}
+			l.logger.Log("removing torn object", "oid", oid, "path", obj.path)
+			if err := os.Remove(obj.path); err != nil {
+				return fmt.Errorf("error removing torn object: %w", err)
+			}
+			if err := l.adjustUsage(-info.Size()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package local
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+// Layout maps object IDs to paths within an objects directory.
+type Layout interface {
+	// Name returns the name of the layout.
+	Name() string
+	// Path returns the slash-separated path of an object relative to the
+	// objects directory, and whether oid is a valid object ID that has one.
+	Path(oid string) (string, bool)
+	// Oid returns the object ID stored at the given slash-separated relative
+	// path, and whether the path is a valid object path in this layout.
+	Oid(rel string) (string, bool)
+}
+
+// Object layouts.
+var (
+	// DefaultLayout stores objects as `aa/bb/<oid>`, like Git LFS does.
+	DefaultLayout Layout = defaultLayout{}
+	// GitLabLayout stores objects as `aa/bb/<rest of oid>`, like GitLab does.
+	GitLabLayout Layout = gitLabLayout{}
+	// FlatLayout stores all objects in a single directory.
+	FlatLayout Layout = flatLayout{}
+)
+
+// allLayouts are all the known layouts.
+var allLayouts = []Layout{DefaultLayout, GitLabLayout, FlatLayout}
+
+// ParseLayout returns the layout with the given name.
+func ParseLayout(name string) (Layout, error) {
+	for _, l := range allLayouts {
+		if l.Name() == name {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown object layout %q", name)
+}
+
+func validOid(oid string) bool {
+	return transfer.Pointer{Oid: oid}.IsValid()
+}
+
+// invalidOidError is returned when looking up an object by an ID that isn't
+// a SHA-256 hash, which could otherwise name a path outside of the store.
+func invalidOidError(oid string) error {
+	return fmt.Errorf("%w: invalid object ID %q", transfer.ErrParseError, oid)
+}
+
+type defaultLayout struct{}
+
+func (defaultLayout) Name() string { return "default" }
+
+func (defaultLayout) Path(oid string) (string, bool) {
+	if !validOid(oid) {
+		return "", false
+	}
+	return transfer.Pointer{Oid: oid}.RelativePath(), true
+}
+
+func (defaultLayout) Oid(rel string) (string, bool) {
+	parts := strings.Split(rel, "/")
+	if len(parts) != 3 || !validOid(parts[2]) {
+		return "", false
+	}
+	oid := parts[2]
+	return oid, parts[0] == oid[0:2] && parts[1] == oid[2:4]
+}
+
+type gitLabLayout struct{}
+
+func (gitLabLayout) Name() string { return "gitlab" }
+
+func (gitLabLayout) Path(oid string) (string, bool) {
+	if !validOid(oid) {
+		return "", false
+	}
+	return path.Join(oid[0:2], oid[2:4], oid[4:]), true
+}
+
+func (gitLabLayout) Oid(rel string) (string, bool) {
+	parts := strings.Split(rel, "/")
+	if len(parts) != 3 {
+		return "", false
+	}
+	oid := strings.Join(parts, "")
+	return oid, len(parts[0]) == 2 && len(parts[1]) == 2 && validOid(oid)
+}
+
+type flatLayout struct{}
+
+func (flatLayout) Name() string { return "flat" }
+
+func (flatLayout) Path(oid string) (string, bool) {
+	if !validOid(oid) {
+		return "", false
+	}
+	return oid, true
+}
+
+func (flatLayout) Oid(rel string) (string, bool) {
+	return rel, validOid(rel)
+}
+
+// WithLayout stores objects using the given layout. Objects are also looked
+// up in the previous layouts, which keeps them readable while a store is
+// being migrated from one layout to another.
+func WithLayout(layout Layout, previous ...Layout) Option {
+	return func(l *LocalBackend) {
+		l.layout = layout
+		l.previousLayouts = previous
+	}
+}
+
+// Layout returns the layout objects are stored with.
+func (l *LocalBackend) Layout() Layout {
+	return l.layout
+}
+
+// splitCompressionExt splits a compressed object's file name suffix from rel.
+func splitCompressionExt(rel string) (string, string) {
+	for _, ext := range compressionExts {
+		if strings.HasSuffix(rel, ext) {
+			return strings.TrimSuffix(rel, ext), ext
+		}
+	}
+	return rel, ""
+}
+
+// MigrateLayout moves every object stored in the repository with the given
+// layout to the backend's layout and returns the number of objects moved.
+// Objects are linked to their new path before the old one is removed, so
+// they stay readable throughout when the old layout is one of the backend's
+// previous layouts. Upload quarantines are migrated too, so that their
+// objects can still be promoted once the old layout is dropped.
+//
+// An object whose new path already holds different content is left where it
+// is and reported with its old path. Directories left empty are only removed
+// when finish is set, as uploads with the new layout may be creating them
+// concurrently.
+func (l *LocalBackend) MigrateLayout(from Layout, finish bool, conflict func(oid, path string)) (int, error) {
+	if from.Name() == l.layout.Name() {
+		return 0, nil
+	}
+	quarantines, err := l.quarantineDirs()
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, dir := range append([]string{l.objectsDir()}, quarantines...) {
+		n, err := l.migrateDir(dir, from, finish, conflict)
+		moved += n
+		// A quarantine may be removed by promote meanwhile.
+		if err != nil && (dir == l.objectsDir() || !errors.Is(err, fs.ErrNotExist)) {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// migrateDir moves the objects stored in objectsDir with the given layout to
+// the backend's layout and returns the number of objects moved.
+func (l *LocalBackend) migrateDir(objectsDir string, from Layout, finish bool, conflict func(oid, path string)) (int, error) {
+	moved := 0
+	err := filepath.WalkDir(objectsDir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !de.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(objectsDir, p)
+		if err != nil {
+			return err
+		}
+		rel, ext := splitCompressionExt(filepath.ToSlash(rel))
+		oid, ok := from.Oid(rel)
+		if !ok {
+			return nil
+		}
+		if _, ok := l.layout.Oid(rel); ok {
+			// Already where the new layout expects it.
+			return nil
+		}
+		dest, err := l.objectPath(objectsDir, oid)
+		if err != nil {
+			return err
+		}
+		dest += ext
+		if err := linkObject(p, dest); errors.Is(err, fs.ErrExist) {
+			same, err := sameContent(p, dest)
+			if err != nil {
+				return fmt.Errorf("error migrating object %s: %w", oid, err)
+			}
+			if !same {
+				conflict(oid, p)
+				return nil
+			}
+		} else if err != nil {
+			return fmt.Errorf("error migrating object %s: %w", oid, err)
+		}
+		if err := os.Remove(p); err != nil {
+			return fmt.Errorf("error migrating object %s: %w", oid, err)
+		}
+		moved++
+		return nil
+	})
+	if err != nil || !finish {
+		return moved, err
+	}
+	return moved, removeEmptyDirs(objectsDir)
+}
+
+// sameContent reports whether the files at a and b are the same file or have
+// the same content.
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close() // nolint: errcheck
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close() // nolint: errcheck
+	ia, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	ib, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(ia, ib) {
+		return true, nil
+	}
+	if ia.Size() != ib.Size() {
+		return false, nil
+	}
+	bufa, bufb := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		na, erra := io.ReadFull(fa, bufa)
+		nb, errb := io.ReadFull(fb, bufb)
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		if erra == io.EOF || erra == io.ErrUnexpectedEOF {
+			return errb == io.EOF || errb == io.ErrUnexpectedEOF, nil
+		}
+		if erra != nil {
+			return false, erra
+		}
+		if errb != nil {
+			return false, errb
+		}
+	}
+}
+
+// removeEmptyDirs removes empty directories below root.
+func removeEmptyDirs(root string) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, e.Name())
+		if err := removeEmptyDirs(dir); err != nil {
+			return err
+		}
+		if rest, err := os.ReadDir(dir); err == nil && len(rest) == 0 {
+			os.Remove(dir) // nolint: errcheck
+		}
+	}
+	return nil
+}
@@ -2,14 +2,17 @@ package local
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/git-lfs-transfer/transfer"
@@ -25,28 +28,82 @@ type LockFile struct {
 var _ io.Writer = &LockFile{}
 var _ io.Closer = &LockFile{}
 
-// NewLockFile creates a new lock file.
+// StaleLockAge is the age after which the temporary file of a lock file is
+// considered left behind by a process that died. Lock files are only held for
+// as long as it takes to write a lock.
+const StaleLockAge = time.Minute
+
+// WithLockOwner records name as the owner of the locks created, instead of
+// the system user owning their files, for servers serving every user from
+// the same system account. Locks owned by name are reported as ours.
+func WithLockOwner(name string) Option {
+	return func(l *LocalBackend) {
+		l.lockOwner = name
+	}
+}
+
+// NewLockFile creates a new lock file. It returns transfer.ErrConflict if
+// another lock file is being written at the same path. A temporary file left
+// behind by a process that died is removed instead.
 func NewLockFile(path string) (*LockFile, error) {
 	temp := path + ".lock"
 	lf := &LockFile{
 		path: path,
 		temp: temp,
 	}
-	// If the lock file already exists, return an error.
-	if _, err := os.Stat(temp); err == nil {
-		f, err := os.Open(temp)
+	for retried := false; ; retried = true {
+		f, err := os.OpenFile(temp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			lf.tempFile = f
+			return lf, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if !retried && removeStale(temp, StaleLockAge) {
+			continue
+		}
+		// If the lock file already exists, return an error.
+		f, err = os.Open(temp)
 		if err != nil {
 			return nil, transfer.ErrConflict
 		}
 		lf.tempFile = f
 		return lf, transfer.ErrConflict
 	}
-	f, err := os.Create(temp)
-	if err != nil {
-		return nil, err
+}
+
+// removeStale removes the file at path if it wasn't modified for age, and
+// reports whether it's gone. Another process may replace the stale file with a
+// fresh one after it's checked, so it's first moved aside under a unique name,
+// and only removed if it's still the file found stale. Otherwise the fresh
+// file is put back.
+func removeStale(path string, age time.Duration) bool {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	if err != nil || time.Since(info.ModTime()) < age {
+		return false
+	}
+	randBytes := make([]byte, 8)
+	if _, err := rand.Read(randBytes); err != nil {
+		return false
+	}
+	// Keep the .lock suffix, so that Cleanup removes it if we die.
+	aside := fmt.Sprintf("%s.%x.lock", strings.TrimSuffix(path, ".lock"), randBytes)
+	if err := os.Rename(path, aside); err != nil {
+		return errors.Is(err, fs.ErrNotExist)
 	}
-	lf.tempFile = f
-	return lf, nil
+	moved, err := os.Stat(aside)
+	if err == nil && os.SameFile(info, moved) {
+		os.Remove(aside) // nolint: errcheck
+		return true
+	}
+	if err := os.Link(aside, path); err == nil {
+		os.Remove(aside) // nolint: errcheck
+	}
+	return false
 }
 
 // Write writes the given data to the lock file.
@@ -89,6 +146,9 @@ type localBackendLock struct {
 	pathName  string
 	time      *time.Time
 	ownerName string
+	// user is the name of the user the session is served for, or empty
+	// for the system user.
+	user string
 }
 
 // NewLocalBackendLock creates a new local backend lock.
@@ -144,9 +204,13 @@ func (l *localBackendLock) AsLockSpec(ownerID bool) ([]string, error) {
 		fmt.Sprintf("ownername %s %s", id, l.OwnerName()),
 	}
 	if ownerID {
-		user, err := l.CurrentUser()
-		if err != nil {
-			return nil, fmt.Errorf("error getting current user: %w", err)
+		user := l.user
+		if user == "" {
+			var err error
+			user, err = l.CurrentUser()
+			if err != nil {
+				return nil, fmt.Errorf("error getting current user: %w", err)
+			}
 		}
 		who := "theirs"
 		if user == l.OwnerName() {
@@ -12,6 +12,12 @@ import (
 
 // CurrentUser returns the current user name.
 func (l *localBackendLock) CurrentUser() (string, error) {
+	return CurrentUser()
+}
+
+// CurrentUser returns the name of the user running the process, which is the
+// name locks created by this process are owned by.
+func CurrentUser() (string, error) {
 	uid := syscall.Getuid()
 	user, err := user.LookupId(strconv.Itoa(uid))
 	if err != nil {
@@ -5,5 +5,11 @@ package local
 
 // CurrentUser returns the current user name.
 func (l *localBackendLock) CurrentUser() (string, error) {
+	return CurrentUser()
+}
+
+// CurrentUser returns the name of the user running the process, which is the
+// name locks created by this process are owned by.
+func CurrentUser() (string, error) {
 	return "unknown", nil
 }
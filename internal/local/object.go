@@ -0,0 +1,137 @@
+package local
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+)
+
+// object is an object stored by the local backend.
+type object struct {
+	// path is the location of the object on disk.
+	path string
+	// size is the logical, uncompressed size of the object.
+	size int64
+	// compression is the algorithm the object is stored with.
+	compression string
+	// torn is set when the object is compressed but its header is missing,
+	// as happens when a crash loses its contents.
+	torn bool
+}
+
+// open opens the object and returns a reader of its uncompressed contents.
+func (o *object) open() (io.ReadCloser, int64, error) {
+	if o.compression != CompressionNone {
+		return openCompressed(o.path, o.compression)
+	}
+	f, err := os.Open(o.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close() // nolint: errcheck
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// stat looks up the object with the given oid in the repository, then in its
+// alternates and the shared pool. It returns an error wrapping fs.ErrNotExist
+// if the object doesn't exist.
+func (l *LocalBackend) stat(oid string) (*object, error) {
+	for _, dir := range l.objectDirs() {
+		obj, err := l.statIn(dir, oid)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		return obj, err
+	}
+	return nil, &fs.PathError{Op: "stat", Path: oid, Err: fs.ErrNotExist}
+}
+
+// objectDirs returns the objects directories objects are looked up in, in
+// order of precedence.
+func (l *LocalBackend) objectDirs() []string {
+	dirs := []string{l.objectsDir()}
+	dirs = append(dirs, l.alternates...)
+	if l.sharedPool != "" {
+		dirs = append(dirs, l.sharedPool)
+	}
+	return dirs
+}
+
+// statIn looks up the object with the given oid in an objects directory,
+// trying the current layout before the previous ones, and then every other
+// layout, so that sessions started before a layout migration find the objects
+// it moves. Objects stored uncompressed take precedence over compressed ones.
+func (l *LocalBackend) statIn(objectsDir, oid string) (*object, error) {
+	for _, layout := range l.lookupLayouts() {
+		path, err := layoutPath(objectsDir, layout, oid)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err == nil {
+			return &object{path: path, size: info.Size(), compression: CompressionNone}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, algo := range []string{CompressionZstd, CompressionGzip} {
+			obj, err := statCompressed(path+compressionExts[algo], algo)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return obj, err
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: oid, Err: fs.ErrNotExist}
+}
+
+// objectAt returns the object stored at path, compressed if its extension
+// says so.
+func objectAt(path string) (*object, error) {
+	for algo, ext := range compressionExts {
+		if strings.HasSuffix(path, ext) {
+			return statCompressed(path, algo)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &object{path: path, size: info.Size(), compression: CompressionNone}, nil
+}
+
+// statCompressed reads the logical size of a compressed object.
+func statCompressed(path string, algo string) (*object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	size, err := readLogicalSize(f)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &object{path: path, compression: algo, torn: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &object{path: path, size: size, compression: algo}, nil
+}
+
+// lookupLayouts returns the layouts objects are looked up with, in order of
+// precedence.
+func (l *LocalBackend) lookupLayouts() []Layout {
+	layouts := append([]Layout{l.layout}, l.previousLayouts...)
+	for _, layout := range allLayouts {
+		if !slices.ContainsFunc(layouts, func(o Layout) bool { return o.Name() == layout.Name() }) {
+			layouts = append(layouts, layout)
+		}
+	}
+	return layouts
+}
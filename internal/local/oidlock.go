@@ -0,0 +1,59 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/flock"
+)
+
+// lockOid takes an exclusive lock on uploads of oid, shared by every process
+// serving the repository, and returns a function releasing it. The lock file
+// is removed on release, so holders check they locked the file still in
+// place and start over otherwise.
+func (l *LocalBackend) lockOid(oid string) (func(), error) {
+	release, err := lockFile(filepath.Join(l.lfsPath, "incomplete", oid+".lock"), false)
+	if err != nil {
+		return nil, fmt.Errorf("error taking upload lock: %w", err)
+	}
+	return release, nil
+}
+
+// lockFile takes an exclusive lock on the file at path, created if needed,
+// and returns a function releasing it and removing the file. With try, it
+// returns a nil function instead of waiting when the lock is held.
+func lockFile(path string, try bool) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		if try {
+			ok, err := flock.TryLock(f)
+			if err != nil || !ok {
+				f.Close() // nolint: errcheck
+				return nil, err
+			}
+		} else if err := flock.Lock(f); err != nil {
+			f.Close() // nolint: errcheck
+			return nil, err
+		}
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close() // nolint: errcheck
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err != nil || !os.SameFile(locked, current) {
+			// Released and removed by another holder meanwhile.
+			f.Close() // nolint: errcheck
+			continue
+		}
+		return func() {
+			os.Remove(path) // nolint: errcheck
+			flock.Unlock(f) // nolint: errcheck
+			f.Close()       // nolint: errcheck
+		}, nil
+	}
+}
@@ -0,0 +1,32 @@
+package local
+
+import (
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Prune removes the objects stored in the repository for which keep returns
+// false and that were last modified before the given time. report is called
+// with the object ID and on-disk size of every pruned object. Nothing is
+// removed when dryRun is set.
+func (l *LocalBackend) Prune(keep func(oid string) bool, before time.Time, dryRun bool, report func(oid string, size int64)) error {
+	var removed int64
+	err := l.walkObjects(func(oid, path string, info fs.FileInfo) error {
+		if oid == "" || keep(oid) || !info.ModTime().Before(before) {
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			removed += info.Size()
+		}
+		report(oid, info.Size())
+		return nil
+	})
+	if uerr := l.adjustUsage(-removed); err == nil {
+		err = uerr
+	}
+	return err
+}
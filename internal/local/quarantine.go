@@ -0,0 +1,257 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WithUploadQuarantine stores uploaded objects in a quarantine area private
+// to the given upload session, `lfs/quarantine/<session>`, instead of the
+// repository's objects directory. Quarantined objects are only served to
+// uploaders, so that they can be verified and aren't uploaded twice, until
+// Promote moves them into the store.
+func WithUploadQuarantine(session string) Option {
+	return func(l *LocalBackend) {
+		l.quarantine = session
+	}
+}
+
+// WithAllQuarantines looks up uploaded objects in every session's upload
+// quarantine, for hooks checking a push, which don't know the session its
+// objects were uploaded in.
+func WithAllQuarantines() Option {
+	return func(l *LocalBackend) {
+		l.allQuarantines = true
+	}
+}
+
+// quarantineRoot returns the directory holding the upload quarantines.
+func (l *LocalBackend) quarantineRoot() string {
+	return filepath.Join(l.lfsPath, "quarantine")
+}
+
+// uploadDir returns the objects directory uploads are stored in.
+func (l *LocalBackend) uploadDir() string {
+	if l.quarantine == "" {
+		return l.objectsDir()
+	}
+	return filepath.Join(l.quarantineRoot(), l.quarantine, "objects")
+}
+
+// sessionLockPath returns the path of the lock held by the upload session of
+// a quarantine while it writes to it.
+func (l *LocalBackend) sessionLockPath(session string) string {
+	return filepath.Join(l.quarantineRoot(), session+".lock")
+}
+
+// lockSession takes the lock of the upload session's quarantine, so that
+// Promote and PruneQuarantine don't remove its directories while objects are
+// stored in them, and returns a function releasing it. It does nothing
+// without a quarantine.
+func (l *LocalBackend) lockSession() (func(), error) {
+	if l.quarantine == "" {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(l.quarantineRoot(), 0777); err != nil {
+		return nil, err
+	}
+	release, err := lockFile(l.sessionLockPath(l.quarantine), false)
+	if err != nil {
+		return nil, fmt.Errorf("error taking quarantine lock: %w", err)
+	}
+	return release, nil
+}
+
+// storeDirs returns the objects directories the session stores objects in:
+// the repository's and the session's quarantine.
+func (l *LocalBackend) storeDirs() []string {
+	if l.quarantine == "" {
+		return []string{l.objectsDir()}
+	}
+	return []string{l.objectsDir(), l.uploadDir()}
+}
+
+// quarantineDirs returns the objects directories of every upload quarantine.
+func (l *LocalBackend) quarantineDirs() ([]string, error) {
+	entries, err := os.ReadDir(l.quarantineRoot())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs = append(dirs, filepath.Join(l.quarantineRoot(), e.Name(), "objects"))
+		}
+	}
+	return dirs, nil
+}
+
+// statUploaded looks up an object like stat does, then in the session's
+// upload quarantine. Other sessions' quarantines are left alone, as their
+// objects may never be pushed, unless WithAllQuarantines is set.
+func (l *LocalBackend) statUploaded(oid string) (*object, error) {
+	obj, err := l.stat(oid)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return obj, err
+	}
+	var dirs []string
+	if l.allQuarantines {
+		var qerr error
+		if dirs, qerr = l.quarantineDirs(); qerr != nil {
+			return nil, qerr
+		}
+	} else if l.quarantine != "" {
+		dirs = []string{l.uploadDir()}
+	}
+	for _, dir := range dirs {
+		obj, qerr := l.statIn(dir, oid)
+		if errors.Is(qerr, fs.ErrNotExist) {
+			continue
+		}
+		return obj, qerr
+	}
+	return nil, err
+}
+
+// Promote moves the quarantined objects for which keep returns true into the
+// repository's objects directory, and returns how many were moved. promoted,
+// if not nil, is called with the oid and size of every object moved. Objects
+// already in the store are dropped from the quarantine. The directories of
+// quarantines whose session is still storing objects are kept.
+func (l *LocalBackend) Promote(keep func(oid string) bool, promoted func(oid string, size int64)) (int, error) {
+	dirs, err := l.quarantineDirs()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, dir := range dirs {
+		err := l.walkObjectsIn(dir, func(oid, path string, info fs.FileInfo) error {
+			if oid == "" || !keep(oid) {
+				return nil
+			}
+			if obj, err := l.statIn(l.objectsDir(), oid); err == nil && !obj.torn {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+				return l.adjustUsage(-info.Size())
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			_, ext := splitCompressionExt(rel)
+			dest, err := l.objectPath(l.objectsDir(), oid)
+			if err != nil {
+				return err
+			}
+			dest += ext
+			if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+				return err
+			}
+			if err := os.Rename(path, dest); err != nil {
+				return fmt.Errorf("error promoting object %s: %w", oid, err)
+			}
+			if err := l.syncDirs(dest, l.objectsDir()); err != nil {
+				return err
+			}
+			n++
+			if promoted != nil {
+				if obj, err := objectAt(dest); err == nil {
+					promoted(oid, obj.size)
+				}
+			}
+			if l.sharedPool != "" {
+				return l.linkIntoPool(oid, dest)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return n, err
+		}
+		if err := l.removeSession(filepath.Dir(dir), removeEmptyDirs); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// PruneQuarantine removes the upload quarantines nothing was written to since
+// the given time, left behind by pushes that were rejected or never happened.
+// report is called with the session and total size of every quarantine
+// removed.
+func (l *LocalBackend) PruneQuarantine(before time.Time, report func(session string, size int64)) error {
+	dirs, err := l.quarantineDirs()
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		session := filepath.Dir(dir)
+		var size int64
+		latest := time.Time{}
+		err := filepath.WalkDir(session, func(_ string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := de.Info()
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+			if info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !latest.Before(before) {
+			continue
+		}
+		removed := false
+		err = l.removeSession(session, func(session string) error {
+			removed = true
+			return os.RemoveAll(session)
+		})
+		if err != nil {
+			return err
+		}
+		if !removed {
+			continue
+		}
+		if err := l.adjustUsage(-size); err != nil {
+			return err
+		}
+		report(filepath.Base(session), size)
+	}
+	return nil
+}
+
+// removeSession calls remove with the directory of a session's quarantine,
+// then removes the directory if it's empty, unless the session holds its
+// lock.
+func (l *LocalBackend) removeSession(session string, remove func(string) error) error {
+	release, err := lockFile(l.sessionLockPath(filepath.Base(session)), true)
+	if err != nil {
+		return fmt.Errorf("error taking quarantine lock: %w", err)
+	}
+	if release == nil {
+		l.logger.Log("upload session still active, keeping its quarantine", "session", filepath.Base(session))
+		return nil
+	}
+	defer release()
+	if err := remove(session); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	os.Remove(session) // nolint: errcheck
+	return nil
+}
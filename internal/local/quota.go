@@ -0,0 +1,278 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/flock"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	"github.com/git-lfs/git-lfs/v3/tools/humanize"
+)
+
+// WithQuota limits the total on-disk size of the repository's objects to
+// maxTotal bytes, and the size of a single object to maxObject bytes. Zero
+// means no limit.
+func WithQuota(maxTotal, maxObject int64) Option {
+	return func(l *LocalBackend) {
+		l.maxTotal = maxTotal
+		l.maxObject = maxObject
+	}
+}
+
+// Quota returns the configured quotas, as passed to WithQuota.
+func (l *LocalBackend) Quota() (maxTotal, maxObject int64) {
+	return l.maxTotal, l.maxObject
+}
+
+// usagePath returns the path of the file recording the repository's usage.
+func (l *LocalBackend) usagePath() string {
+	return filepath.Join(l.lfsPath, "usage")
+}
+
+// Usage returns the on-disk size of the repository's objects. The usage is
+// recorded in `lfs/usage` and kept up to date as objects are added and
+// removed. It's computed from the objects directory when nothing is recorded
+// yet.
+func (l *LocalBackend) Usage() (int64, error) {
+	var usage int64
+	err := l.updateUsage(true, func(u int64) (int64, error) {
+		usage = u
+		return u, nil
+	})
+	return usage, err
+}
+
+// RecountUsage recomputes the usage from the objects directory and records
+// it.
+func (l *LocalBackend) RecountUsage() (int64, error) {
+	var usage int64
+	err := l.updateUsage(true, func(int64) (int64, error) {
+		var err error
+		usage, err = l.diskUsage()
+		return usage, err
+	})
+	return usage, err
+}
+
+// adjustUsage adds delta to the recorded usage. Nothing happens when no usage
+// is recorded, it's computed the next time it's needed.
+func (l *LocalBackend) adjustUsage(delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	return l.updateUsage(false, func(u int64) (int64, error) {
+		return u + delta, nil
+	})
+}
+
+// updateUsage calls fn with the recorded usage while holding a lock on the
+// usage file, and records the usage fn returns. If nothing is recorded yet,
+// the usage is computed first when create is set, and fn isn't called
+// otherwise.
+func (l *LocalBackend) updateUsage(create bool, fn func(int64) (int64, error)) error {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(l.usagePath(), flags, 0666)
+	if errors.Is(err, fs.ErrNotExist) && !create {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	if err := flock.Lock(f); err != nil {
+		return fmt.Errorf("error locking usage file: %w", err)
+	}
+	defer flock.Unlock(f) // nolint: errcheck
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	usage, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		// Nothing recorded yet, or garbage.
+		if usage, err = l.diskUsage(); err != nil {
+			return err
+		}
+	}
+	updated, err := fn(usage)
+	if err != nil {
+		return err
+	}
+	if updated < 0 {
+		updated = 0
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt([]byte(strconv.FormatInt(updated, 10)+"\n"), 0)
+	return err
+}
+
+// diskUsage sums the sizes of the files in the repository's objects
+// directory and upload quarantines.
+func (l *LocalBackend) diskUsage() (int64, error) {
+	dirs, err := l.quarantineDirs()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, dir := range append([]string{l.objectsDir()}, dirs...) {
+		err := l.walkObjectsIn(dir, func(_, _ string, info fs.FileInfo) error {
+			total += info.Size()
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// checkObjectSize returns an error wrapping transfer.ErrTooLarge if an object
+// of the given size is over the single object quota.
+func (l *LocalBackend) checkObjectSize(oid string, size int64) error {
+	if l.maxObject > 0 && size > l.maxObject {
+		return fmt.Errorf("%w: object %s is %s, over the %s limit", transfer.ErrTooLarge,
+			oid, humanize.FormatBytes(uint64(size)), humanize.FormatBytes(uint64(l.maxObject)))
+	}
+	return nil
+}
+
+// checkTotal returns an error wrapping transfer.ErrTooLarge if adding size
+// bytes to usage goes over the repository quota.
+func (l *LocalBackend) checkTotal(usage, size int64) error {
+	if l.maxTotal > 0 && usage+size > l.maxTotal {
+		return fmt.Errorf("%w: uploading %s would exceed the repository quota, %s of %s used", transfer.ErrTooLarge,
+			humanize.FormatBytes(uint64(size)), humanize.FormatBytes(uint64(usage)), humanize.FormatBytes(uint64(l.maxTotal)))
+	}
+	return nil
+}
+
+// checkBatch checks that uploading the missing items of a batch fits in the
+// quotas.
+func (l *LocalBackend) checkBatch(items []transfer.BatchItem) error {
+	if l.maxTotal == 0 && l.maxObject == 0 {
+		return nil
+	}
+	var incoming int64
+	for _, item := range items {
+		if item.Present {
+			continue
+		}
+		if err := l.checkObjectSize(item.Oid, item.Size); err != nil {
+			return err
+		}
+		incoming += item.Size
+	}
+	if l.maxTotal == 0 || incoming == 0 {
+		return nil
+	}
+	usage, err := l.Usage()
+	if err != nil {
+		return err
+	}
+	return l.checkTotal(usage, incoming)
+}
+
+// quotaReader fails with transfer.ErrTooLarge once more than limit bytes
+// have been read.
+type quotaReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+	err   func(read int64) error
+}
+
+// Read implements io.Reader.
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.read += int64(n)
+	if q.read > q.limit {
+		return n, q.err(q.read)
+	}
+	return n, err
+}
+
+// limitUpload checks the announced size of an upload of oid against the
+// quotas, and wraps its data so that reading it fails as soon as it goes over
+// them, whatever size the client announced.
+func (l *LocalBackend) limitUpload(oid string, size int64, r io.Reader) (io.Reader, error) {
+	if l.maxTotal == 0 && l.maxObject == 0 {
+		return r, nil
+	}
+	if err := l.checkObjectSize(oid, size); err != nil {
+		return nil, err
+	}
+	limit := int64(-1)
+	if l.maxObject > 0 {
+		limit = l.maxObject
+	}
+	var usage int64
+	if l.maxTotal > 0 {
+		var err error
+		if usage, err = l.Usage(); err != nil {
+			return nil, err
+		}
+		if err := l.checkTotal(usage, size); err != nil {
+			return nil, err
+		}
+		if left := l.maxTotal - usage; limit < 0 || left < limit {
+			limit = left
+		}
+	}
+	return &quotaReader{r: r, limit: limit, err: func(read int64) error {
+		if err := l.checkObjectSize(oid, read); err != nil {
+			return err
+		}
+		return l.checkTotal(usage, read)
+	}}, nil
+}
+
+// storeObject links the uploaded file at src into the store at dest and
+// accounts for it. With a repository quota, the quota is checked again while
+// holding the usage lock, so that concurrent uploads can't overrun it.
+func (l *LocalBackend) storeObject(src, dest string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if l.maxTotal == 0 {
+		if err := linkObject(src, dest); err != nil {
+			return err
+		}
+		return l.adjustUsage(info.Size())
+	}
+	return l.updateUsage(true, func(usage int64) (int64, error) {
+		if err := l.checkTotal(usage, info.Size()); err != nil {
+			return usage, err
+		}
+		if err := linkObject(src, dest); err != nil {
+			return usage, err
+		}
+		return usage + info.Size(), nil
+	})
+}
+
+// linkObject links src to dest, creating the parent directory of dest. A
+// layout migration finishing meanwhile may remove that directory while it is
+// empty, so linking is retried a few times when it disappears.
+func linkObject(src, dest string) error {
+	for i := 0; ; i++ {
+		if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+			return err
+		}
+		err := os.Link(src, dest)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) || i == 2 {
+			return err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+var (
+	_ transfer.RepairFlagger     = &LocalBackend{}
+	_ transfer.VerificationCache = &LocalBackend{}
+)
+
+// WithVerifiedCache remembers objects found intact when downloaded for ttl,
+// during which downloads of them aren't verified again. Zero disables the
+// cache.
+func WithVerifiedCache(ttl time.Duration) Option {
+	return func(l *LocalBackend) {
+		l.verifiedTTL = ttl
+	}
+}
+
+// repairDir returns the directory holding the flags of objects needing
+// repair.
+func (l *LocalBackend) repairDir() string {
+	return filepath.Join(l.lfsPath, "repair")
+}
+
+// verifiedDir returns the directory recording when objects were last
+// verified.
+func (l *LocalBackend) verifiedDir() string {
+	return filepath.Join(l.lfsPath, "verified")
+}
+
+// FlagForRepair implements transfer.RepairFlagger. It records the object in
+// `lfs/repair/<oid>`, along with when and why it was found corrupt.
+func (l *LocalBackend) FlagForRepair(oid string, reason error) error {
+	if !validOid(oid) {
+		return fmt.Errorf("invalid object ID %q", oid)
+	}
+	if err := os.MkdirAll(l.repairDir(), 0777); err != nil {
+		return err
+	}
+	l.logger.Log("object flagged for repair", "oid", oid, "reason", reason)
+	os.Remove(filepath.Join(l.verifiedDir(), oid)) // nolint: errcheck
+	msg := fmt.Sprintf("%s %v\n", time.Now().UTC().Format(time.RFC3339), reason)
+	return os.WriteFile(filepath.Join(l.repairDir(), oid), []byte(msg), 0666)
+}
+
+// FlaggedForRepair returns the IDs of the objects flagged for repair, sorted.
+func (l *LocalBackend) FlaggedForRepair() ([]string, error) {
+	entries, err := os.ReadDir(l.repairDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var oids []string
+	for _, e := range entries {
+		if validOid(e.Name()) {
+			oids = append(oids, e.Name())
+		}
+	}
+	sort.Strings(oids)
+	return oids, nil
+}
+
+// Verified implements transfer.VerificationCache. An object counts as
+// verified if it was found intact within the cache TTL and hasn't been
+// replaced since.
+func (l *LocalBackend) Verified(oid string) bool {
+	if l.verifiedTTL <= 0 || !validOid(oid) {
+		return false
+	}
+	obj, err := l.stat(oid)
+	if err != nil {
+		return false
+	}
+	objInfo, err := os.Stat(obj.path)
+	return err == nil && l.verifiedSince(oid, objInfo)
+}
+
+// verifiedSince reports whether oid was found intact within the cache TTL,
+// after the file described by objInfo was last modified.
+func (l *LocalBackend) verifiedSince(oid string, objInfo fs.FileInfo) bool {
+	if l.verifiedTTL <= 0 || !validOid(oid) {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(l.verifiedDir(), oid))
+	if err != nil || time.Since(info.ModTime()) > l.verifiedTTL {
+		return false
+	}
+	return !objInfo.ModTime().After(info.ModTime())
+}
+
+// MarkVerified implements transfer.VerificationCache.
+func (l *LocalBackend) MarkVerified(oid string) error {
+	if l.verifiedTTL <= 0 || !validOid(oid) {
+		return nil
+	}
+	if err := os.MkdirAll(l.verifiedDir(), 0777); err != nil {
+		return err
+	}
+	path := filepath.Join(l.verifiedDir(), oid)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return nil
+	}
+	return os.WriteFile(path, nil, 0666)
+}
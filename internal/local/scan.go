@@ -0,0 +1,24 @@
+package local
+
+import "github.com/charmbracelet/git-lfs-transfer/transfer"
+
+// WithScanners has uploaded objects scanned once their data is complete and
+// verified, before they're stored. Objects must pass every scanner given.
+// Objects already stored aren't scanned again.
+func WithScanners(scanners ...transfer.Scanner) Option {
+	return func(l *LocalBackend) {
+		l.scanners = append(l.scanners, scanners...)
+	}
+}
+
+// scan runs the scanners on the upload of oid, whose data is in the file at
+// path.
+func (l *LocalBackend) scan(oid, path string) error {
+	for _, scanner := range l.scanners {
+		if err := scanner.Scan(oid, path); err != nil {
+			l.logger.Log("upload rejected by scanner", "oid", oid, "err", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package local
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/throttle"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+// Replica is another store holding copies of the repository's objects, which
+// corrupt objects can be repaired from.
+type Replica struct {
+	// Name identifies the replica in reports.
+	Name string
+	// Backend serves the replica's objects.
+	Backend transfer.Backend
+}
+
+// ScrubOptions are the options of Scrub.
+type ScrubOptions struct {
+	// Limit bounds the rate objects are read at. Nil means no limit.
+	Limit *throttle.Bucket
+	// MaxDuration stops the scrub after the given time, zero means no limit.
+	// The next scrub resumes where it stopped.
+	MaxDuration time.Duration
+	// Restart starts over from the first object instead of resuming an
+	// unfinished scrub.
+	Restart bool
+	// Replicas are tried in order for a good copy of corrupt objects.
+	Replicas []Replica
+}
+
+// ScrubStatus records the progress of a scrub, in `lfs/scrub/status.json`.
+type ScrubStatus struct {
+	// Started is when the scrub started, or when the scrub it resumes did.
+	Started time.Time `json:"started"`
+	// Updated is when the status was last recorded.
+	Updated time.Time `json:"updated"`
+	// Checked is the number of objects checked.
+	Checked int `json:"checked"`
+	// Bytes is the on-disk size of the objects checked.
+	Bytes int64 `json:"bytes"`
+	// Problems is the number of problems found.
+	Problems int `json:"problems"`
+	// Repaired is the number of objects repaired from a replica.
+	Repaired int `json:"repaired"`
+	// Complete is set once every object has been checked.
+	Complete bool `json:"complete"`
+	// Checkpoint is the path, relative to the objects directory, of the last
+	// object checked by an unfinished scrub.
+	Checkpoint string `json:"checkpoint,omitempty"`
+}
+
+// errScrubStopped stops the walk of a scrub out of time.
+var errScrubStopped = errors.New("scrub stopped")
+
+// scrubStatusPath returns the path of the file recording the scrub status.
+func (l *LocalBackend) scrubStatusPath() string {
+	return filepath.Join(l.lfsPath, "scrub", "status.json")
+}
+
+// ScrubStatus returns the status of the last scrub, or a zero status if no
+// scrub ever ran.
+func (l *LocalBackend) ScrubStatus() (ScrubStatus, error) {
+	var st ScrubStatus
+	data, err := os.ReadFile(l.scrubStatusPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("error reading scrub status: %w", err)
+	}
+	return st, nil
+}
+
+// saveScrubStatus records st, replacing the previous status atomically.
+func (l *LocalBackend) saveScrubStatus(st ScrubStatus) error {
+	st.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := l.scrubStatusPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Scrub re-hashes the objects stored in the repository, like Fsck but at a
+// bounded rate and resuming where the previous scrub stopped. Corrupt and
+// truncated objects are repaired from the first replica holding a good copy,
+// and flagged for repair otherwise. report is called for every problem found.
+// The progress is recorded as the scrub goes, so that a scrub that is
+// interrupted resumes from the last checkpoint.
+func (l *LocalBackend) Scrub(opts ScrubOptions, report func(Problem) error) (ScrubStatus, error) {
+	st, err := l.ScrubStatus()
+	if err != nil {
+		return st, err
+	}
+	if opts.Restart || st.Complete || st.Checkpoint == "" {
+		st = ScrubStatus{Started: time.Now().UTC()}
+	}
+	var deadline time.Time
+	if opts.MaxDuration > 0 {
+		deadline = time.Now().Add(opts.MaxDuration)
+	}
+	resume := st.Checkpoint
+	saved := time.Now()
+	err = l.walkObjects(func(oid, path string, info fs.FileInfo) error {
+		rel, err := filepath.Rel(l.objectsDir(), path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if resume != "" && !pathAfter(rel, resume) {
+			return nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return errScrubStopped
+		}
+		st.Checked++
+		st.Bytes += info.Size()
+		st.Checkpoint = rel
+		if p := l.scrubObject(oid, path, info, opts); p != nil {
+			st.Problems++
+			if p.Repaired != "" {
+				st.Repaired++
+			}
+			if err := report(*p); err != nil {
+				return err
+			}
+		}
+		if time.Since(saved) > 10*time.Second {
+			saved = time.Now()
+			return l.saveScrubStatus(st)
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errScrubStopped):
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		l.saveScrubStatus(st) // nolint: errcheck
+		return st, err
+	default:
+		st.Complete = true
+		st.Checkpoint = ""
+	}
+	return st, l.saveScrubStatus(st)
+}
+
+// pathAfter reports whether the slash-separated path a comes after b in the
+// order objects are walked in, which sorts path elements one by one.
+func pathAfter(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] > bs[i]
+		}
+	}
+	return len(as) > len(bs)
+}
+
+// scrubObject checks one object, repairing or flagging it if it is bad. It
+// returns nil if the object is fine.
+func (l *LocalBackend) scrubObject(oid, path string, info fs.FileInfo, opts ScrubOptions) *Problem {
+	p := l.checkObject(oid, path, info, opts.Limit)
+	if p == nil {
+		if err := os.Remove(filepath.Join(l.repairDir(), oid)); err == nil {
+			l.logger.Log("object no longer needs repair", "oid", oid)
+		}
+		return nil
+	}
+	if oid == "" || p.Kind == ProblemMisplaced {
+		return p
+	}
+	reason := fmt.Errorf("%w: %s", transfer.ErrCorruptData, p.Message)
+	for _, replica := range opts.Replicas {
+		err := l.repairFrom(replica, oid, path, reason, opts.Limit)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			l.logger.Log("error repairing object", "oid", oid, "replica", replica.Name, "err", err)
+			continue
+		}
+		p.Repaired = replica.Name
+		os.Remove(filepath.Join(l.repairDir(), oid)) // nolint: errcheck
+		return p
+	}
+	if err := l.FlagForRepair(oid, reason); err != nil {
+		l.logger.Log("error flagging object for repair", "oid", oid, "err", err)
+	}
+	return p
+}
+
+// repairFrom replaces the corrupt object oid stored at path with the copy
+// held by replica. The copy is downloaded to a temporary file and verified
+// before it takes the place of the corrupt object, which is then moved to
+// `lfs/corrupt`, so that a failure leaves the store as it was. It returns an
+// error wrapping fs.ErrNotExist if the replica has no good copy.
+func (l *LocalBackend) repairFrom(replica Replica, oid, path string, reason error, limit *throttle.Bucket) error {
+	r, size, err := replica.Backend.Download(oid, nil)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Join(l.lfsPath, "incomplete"), oid+"-repair-")
+	if err != nil {
+		r.Close() // nolint: errcheck
+		return err
+	}
+	temp := f.Name()
+	defer os.Remove(temp) // nolint: errcheck
+	hr := transfer.NewHashingReader(throttle.NewReader(r, limit), sha256.New())
+	_, err = io.Copy(f, hr)
+	r.Close() // nolint: errcheck
+	if err == nil {
+		err = l.syncFile(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return l.noSpace(err)
+	}
+	if hr.Oid() != oid || hr.Size() != size {
+		l.logger.Log("replica copy is corrupt too", "oid", oid, "replica", replica.Name)
+		return &fs.PathError{Op: "repair", Path: oid, Err: fs.ErrNotExist}
+	}
+	release, err := l.lockOid(oid)
+	if err != nil {
+		return err
+	}
+	defer release()
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	l.logger.Log("repairing object", "oid", oid, "replica", replica.Name)
+	dest, err := l.objectPath(l.objectsDir(), oid)
+	if err != nil {
+		return err
+	}
+	corrupt, err := l.corruptPath(path)
+	if err != nil {
+		return err
+	}
+	if path == dest {
+		// Keep the corrupt copy before the good one replaces it.
+		os.Remove(corrupt) // nolint: errcheck
+		if err := os.Link(path, corrupt); err != nil {
+			return fmt.Errorf("error quarantining %s: %w", path, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, dest); err != nil {
+		return err
+	}
+	if err := l.syncDirs(dest, l.objectsDir()); err != nil {
+		return err
+	}
+	if _, err := l.FixPermissions(dest); err != nil {
+		return err
+	}
+	if path != dest {
+		// A compressed object or one stored with a previous layout.
+		if err := os.Rename(path, corrupt); err != nil {
+			return fmt.Errorf("error quarantining %s: %w", path, err)
+		}
+	}
+	l.logger.Log("moved corrupt object", "oid", oid, "path", corrupt, "reason", reason)
+	return l.adjustUsage(size - info.Size())
+}
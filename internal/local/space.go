@@ -0,0 +1,51 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	"github.com/git-lfs/git-lfs/v3/tools/humanize"
+)
+
+// WithMinFreeSpace refuses uploads that would leave less than reserve bytes
+// available on the file system holding the repository's objects.
+func WithMinFreeSpace(reserve int64) Option {
+	return func(l *LocalBackend) {
+		l.minFreeSpace = reserve
+	}
+}
+
+// WithLogger logs events operators should know about, such as uploads
+// refused for lack of space, to logger.
+func WithLogger(logger transfer.Logger) Option {
+	return func(l *LocalBackend) {
+		l.logger = logger
+	}
+}
+
+// checkFreeSpace returns an error wrapping transfer.ErrInsufficientStorage
+// if storing size more bytes would leave less than the configured reserve
+// available. Nothing is checked where the available space can't be known.
+func (l *LocalBackend) checkFreeSpace(size int64) error {
+	free, ok, err := freeSpace(l.lfsPath)
+	if err != nil {
+		return fmt.Errorf("error checking free space: %w", err)
+	}
+	if !ok || free-size >= l.minFreeSpace {
+		return nil
+	}
+	l.logger.Log("refusing upload, not enough free space", "path", l.lfsPath, "size", size, "free", free, "reserve", l.minFreeSpace)
+	return fmt.Errorf("%w: not enough space left to store %s", transfer.ErrInsufficientStorage, humanize.FormatBytes(uint64(size)))
+}
+
+// noSpace turns the error of a write that ran out of space into an error
+// wrapping transfer.ErrInsufficientStorage.
+func (l *LocalBackend) noSpace(err error) error {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	l.logger.Log("upload failed, file system full", "path", l.lfsPath, "err", err)
+	return fmt.Errorf("%w: %s", transfer.ErrInsufficientStorage, err)
+}
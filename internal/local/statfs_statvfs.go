@@ -0,0 +1,16 @@
+//go:build netbsd || solaris
+// +build netbsd solaris
+
+package local
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the file system holding path.
+func freeSpace(path string) (int64, bool, error) {
+	var st unix.Statvfs_t
+	if err := unix.Statvfs(path, &st); err != nil {
+		return 0, false, err
+	}
+	return int64(st.Bavail) * int64(st.Frsize), true, nil
+}
@@ -0,0 +1,16 @@
+//go:build darwin || dragonfly || freebsd || linux || openbsd
+// +build darwin dragonfly freebsd linux openbsd
+
+package local
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the file system holding path.
+func freeSpace(path string) (int64, bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, false, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true, nil
+}
@@ -0,0 +1,79 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+// WithDeepVerify makes Verify hash the contents of objects instead of only
+// checking their size.
+func WithDeepVerify() Option {
+	return func(l *LocalBackend) {
+		l.deepVerify = true
+	}
+}
+
+// verifyContents hashes obj and checks it matches oid. Corrupt objects are
+// answered with a 409 status so that the client uploads them again, and are
+// moved out of the way so that the new upload isn't skipped.
+func (l *LocalBackend) verifyContents(oid string, obj *object) (transfer.Status, error) {
+	if l.Verified(oid) {
+		return transfer.SuccessStatus(), nil
+	}
+	actual, _, err := hashObject(obj, nil)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, transfer.ErrCorruptData):
+	case err != nil:
+		return nil, err
+	case actual == oid:
+		if err := l.MarkVerified(oid); err != nil {
+			l.logger.Log("failed to cache verification", "oid", oid, "err", err)
+		}
+		return transfer.SuccessStatus(), nil
+	default:
+		err = fmt.Errorf("%w: object ID mismatch, got %s", transfer.ErrCorruptData, actual)
+	}
+	if err := l.discardCorrupt(oid, obj, err); err != nil {
+		return nil, err
+	}
+	return transfer.NewStatus(transfer.StatusConflict, fmt.Sprintf("corrupt object %s, upload it again", oid)), nil
+}
+
+// discardCorrupt moves a corrupt object found in the repository's objects
+// directory to `lfs/corrupt`, and removes one found in an upload quarantine.
+// Objects found elsewhere, such as in alternates, are flagged for repair
+// instead.
+func (l *LocalBackend) discardCorrupt(oid string, obj *object, reason error) error {
+	release, err := l.lockOid(oid)
+	if err != nil {
+		return err
+	}
+	defer release()
+	info, err := os.Stat(obj.path)
+	if err != nil {
+		return err
+	}
+	sep := string(filepath.Separator)
+	switch {
+	case strings.HasPrefix(obj.path, l.objectsDir()+sep):
+		dest, err := l.quarantineFile(obj.path)
+		if err != nil {
+			return err
+		}
+		l.logger.Log("moved corrupt object", "oid", oid, "path", dest, "reason", reason)
+	case strings.HasPrefix(obj.path, l.quarantineRoot()+sep):
+		if err := os.Remove(obj.path); err != nil {
+			return err
+		}
+		l.logger.Log("removed corrupt object", "oid", oid, "path", obj.path, "reason", reason)
+	default:
+		return l.FlagForRepair(oid, reason)
+	}
+	return l.adjustUsage(-info.Size())
+}
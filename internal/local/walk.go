@@ -0,0 +1,47 @@
+package local
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// walkObjects calls fn for every file in the repository's objects directory.
+// oid is the object ID the file is stored as, or empty if the file isn't at a
+// valid object path in any of the layouts objects are looked up with.
+// Alternates and the shared pool aren't walked.
+func (l *LocalBackend) walkObjects(fn func(oid, path string, info fs.FileInfo) error) error {
+	return l.walkObjectsIn(l.objectsDir(), fn)
+}
+
+// walkObjectsIn is like walkObjects, but walks the given objects directory.
+func (l *LocalBackend) walkObjectsIn(objectsDir string, fn func(oid, path string, info fs.FileInfo) error) error {
+	layouts := l.lookupLayouts()
+	return filepath.WalkDir(objectsDir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.IsDir() {
+			if path == filepath.Join(objectsDir, "info") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(objectsDir, path)
+		if err != nil {
+			return err
+		}
+		rel, _ = splitCompressionExt(filepath.ToSlash(rel))
+		oid := ""
+		for _, layout := range layouts {
+			if o, ok := layout.Oid(rel); ok {
+				oid = o
+				break
+			}
+		}
+		return fn(oid, path, info)
+	})
+}
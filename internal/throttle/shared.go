@@ -0,0 +1,180 @@
+package throttle
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/flock"
+)
+
+// SharedBucket is a token bucket whose state is kept in a file, so that every
+// process using the same file shares its rate. Tokens are taken from the file
+// in batches of a tenth of a second worth of data, so that it's only accessed
+// a few times per second. The directory of the file must only be writable by
+// the current user. A nil SharedBucket doesn't limit anything.
+type SharedBucket struct {
+	mu       sync.Mutex
+	path     string
+	rate     float64
+	burst    float64
+	credit   float64
+	fallback *Bucket
+	onError  func(error)
+	failed   bool
+}
+
+var _ Limiter = (*SharedBucket)(nil)
+
+// NewSharedBucket returns a bucket sharing its state through the file at
+// path, letting rate bytes per second through, with bursts of up to burst
+// bytes. A burst of zero or less defaults to one second worth of data. It
+// returns nil if rate is zero or less. onError, if set, is called the first
+// time the state file can't be used and the bucket falls back to limiting the
+// current process only.
+func NewSharedBucket(path string, rate, burst int64, onError func(error)) *SharedBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &SharedBucket{
+		path:     path,
+		rate:     float64(rate),
+		burst:    float64(burst),
+		fallback: NewBucket(rate, burst),
+		onError:  onError,
+	}
+}
+
+// fail reports the first error using the state file. b.mu must be held.
+func (b *SharedBucket) fail(err error) {
+	if b.failed || b.onError == nil {
+		return
+	}
+	b.failed = true
+	b.onError(err)
+}
+
+// Reserve implements Limiter. If the state file can't be used, the bucket
+// limits the current process only.
+func (b *SharedBucket) Reserve(n int) time.Duration {
+	if b == nil || n <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.credit >= float64(n) {
+		b.credit -= float64(n)
+		return 0
+	}
+	need := float64(n) - b.credit
+	batch := need
+	if min := b.rate / 10; batch < min {
+		batch = min
+	}
+	wait, err := b.take(batch)
+	if err != nil {
+		b.fail(err)
+		b.credit = 0
+		return b.fallback.Reserve(int(need))
+	}
+	b.credit = batch - need
+	return wait
+}
+
+// take takes n tokens from the state file, and returns how long to wait
+// before using them.
+func (b *SharedBucket) take(n float64) (time.Duration, error) {
+	var wait time.Duration
+	err := b.update(func(tokens float64) float64 {
+		tokens -= n
+		if tokens < 0 {
+			wait = time.Duration(-tokens / b.rate * float64(time.Second))
+		}
+		return tokens
+	})
+	return wait, err
+}
+
+// Allow takes n tokens from the bucket if it holds that many, and returns
+// zero. Otherwise it takes nothing and returns how long until it will hold
+// them. Unlike Reserve, it never lets the bucket go into debt.
+func (b *SharedBucket) Allow(n int) time.Duration {
+	if b == nil || n <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var wait time.Duration
+	err := b.update(func(tokens float64) float64 {
+		if tokens >= float64(n) {
+			return tokens - float64(n)
+		}
+		wait = time.Duration((float64(n) - tokens) / b.rate * float64(time.Second))
+		return tokens
+	})
+	if err != nil {
+		b.fail(err)
+		return b.fallback.Allow(n)
+	}
+	return wait
+}
+
+// PrepareDir creates dir, if needed, to hold the state files of shared
+// buckets, and returns an error if it isn't private to the current user.
+func PrepareDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return checkPrivate(dir)
+}
+
+// update calls fn with the tokens the state file holds, refilled for the
+// time elapsed since it was last updated, and records the tokens fn returns.
+// The state file is locked meanwhile.
+func (b *SharedBucket) update(fn func(tokens float64) float64) error {
+	if err := PrepareDir(filepath.Dir(b.path)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(b.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	if err := flock.Lock(f); err != nil {
+		return err
+	}
+	defer flock.Unlock(f) // nolint: errcheck
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tokens, last := b.burst, now
+	if fields := strings.Fields(string(data)); len(fields) == 2 {
+		t, terr := strconv.ParseFloat(fields[0], 64)
+		ns, nerr := strconv.ParseInt(fields[1], 10, 64)
+		if terr == nil && nerr == nil {
+			tokens, last = t, time.Unix(0, ns)
+		}
+	}
+	if elapsed := now.Sub(last); elapsed > 0 {
+		tokens += elapsed.Seconds() * b.rate
+	}
+	if tokens > b.burst {
+		tokens = b.burst
+	}
+	tokens = fn(tokens)
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt([]byte(fmt.Sprintf("%f %d\n", tokens, now.UnixNano())), 0)
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package throttle
+
+// checkPrivate does nothing on platforms without Unix permissions.
+func checkPrivate(string) error {
+	return nil
+}
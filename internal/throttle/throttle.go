@@ -0,0 +1,119 @@
+// Package throttle limits the rate of transfers and requests with token
+// buckets.
+package throttle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter limits the rate of a transfer.
+type Limiter interface {
+	// Reserve takes n bytes and returns how long to wait before
+	// transferring them.
+	Reserve(n int) time.Duration
+}
+
+var _ Limiter = (*Bucket)(nil)
+
+// Bucket is a token bucket holding up to burst bytes and refilled at rate
+// bytes per second. A nil Bucket doesn't limit anything.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a bucket letting rate bytes per second through, with
+// bursts of up to burst bytes. The bucket starts full. A burst of zero or
+// less defaults to one second worth of data. It returns nil if rate is zero
+// or less.
+func NewBucket(rate, burst int64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the bucket was last used. b.mu
+// must be held.
+func (b *Bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Reserve takes n bytes from the bucket and returns how long to wait before
+// using them. The bucket goes into debt when n is more than what it holds, so
+// that transfers larger than the burst are still let through eventually.
+func (b *Bucket) Reserve(n int) time.Duration {
+	if b == nil || n <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Allow takes n tokens from the bucket if it holds that many, and returns
+// zero. Otherwise it takes nothing and returns how long until it will hold
+// them. Unlike Reserve, it never lets the bucket go into debt.
+func (b *Bucket) Allow(n int) time.Duration {
+	if b == nil || n <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		return 0
+	}
+	return time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Reader throttles reads from an io.Reader.
+type Reader struct {
+	r        io.Reader
+	limiters []Limiter
+}
+
+// NewReader returns a reader reading from r no faster than every limiter
+// allows.
+func NewReader(r io.Reader, limiters ...Limiter) *Reader {
+	return &Reader{r: r, limiters: limiters}
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	var wait time.Duration
+	for _, l := range r.limiters {
+		if d := l.Reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
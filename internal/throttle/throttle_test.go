@@ -0,0 +1,69 @@
+package throttle
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketDisabled(t *testing.T) {
+	assert.Nil(t, NewBucket(0, 100))
+	var b *Bucket
+	assert.Zero(t, b.Reserve(1000))
+	assert.Zero(t, b.Allow(1000))
+	assert.Equal(t, float64(100), NewBucket(100, 0).burst)
+}
+
+func TestBucketReserve(t *testing.T) {
+	b := NewBucket(100, 50)
+	assert.Zero(t, b.Reserve(50))
+	// Going into debt: the 100 bytes are ready in a second.
+	assert.InDelta(t, time.Second, b.Reserve(100), float64(10*time.Millisecond))
+	// Refilled for the time elapsed, up to the burst.
+	b.last = time.Now().Add(-time.Hour)
+	assert.Zero(t, b.Reserve(50))
+	assert.InDelta(t, 0, b.tokens, 1)
+}
+
+func TestBucketAllow(t *testing.T) {
+	b := NewBucket(100, 50)
+	// More than the bucket can hold takes nothing.
+	assert.InDelta(t, 100*time.Millisecond, b.Allow(60), float64(10*time.Millisecond))
+	assert.InDelta(t, 50, b.tokens, 1)
+	assert.Zero(t, b.Allow(50))
+	assert.InDelta(t, 500*time.Millisecond, b.Allow(50), float64(10*time.Millisecond))
+	assert.InDelta(t, 0, b.tokens, 1)
+}
+
+func TestSharedBucket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "rate")
+	first := NewSharedBucket(path, 100, 50, func(err error) { t.Error(err) })
+	second := NewSharedBucket(path, 100, 50, func(err error) { t.Error(err) })
+	assert.Zero(t, first.Allow(50))
+	assert.InDelta(t, 500*time.Millisecond, second.Allow(50), float64(10*time.Millisecond))
+	// Reserve takes a tenth of a second worth of tokens at a time.
+	assert.InDelta(t, 100*time.Millisecond, second.Reserve(1), float64(10*time.Millisecond))
+	assert.InDelta(t, 9, second.credit, 0.01)
+	assert.Zero(t, second.Reserve(9))
+}
+
+func TestSharedBucketFallback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix permissions")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorContains(t, PrepareDir(dir), "writable by other users")
+	var errs []error
+	b := NewSharedBucket(filepath.Join(dir, "rate"), 100, 50, func(err error) { errs = append(errs, err) })
+	assert.Zero(t, b.Allow(50))
+	assert.Positive(t, b.Allow(50))
+	assert.Len(t, errs, 1)
+	assert.NoFileExists(t, filepath.Join(dir, "rate"))
+}
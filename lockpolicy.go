@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/lfsgit"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// lockablePolicy only allows locking paths that have the lockable attribute
+// set in the .gitattributes files of the ref being locked on, or of HEAD when
+// that ref isn't given or doesn't exist yet.
+type lockablePolicy struct {
+	repo  *gogit.Repository
+	attrs map[plumbing.Hash]*lfsgit.Attributes
+}
+
+var _ transfer.LockPolicy = &lockablePolicy{}
+
+// newLockablePolicy creates a lockable policy for the given repository.
+func newLockablePolicy(repo *gogit.Repository) *lockablePolicy {
+	return &lockablePolicy{
+		repo:  repo,
+		attrs: map[plumbing.Hash]*lfsgit.Attributes{},
+	}
+}
+
+// CheckLock implements transfer.LockPolicy.
+func (p *lockablePolicy) CheckLock(_ transfer.LockBackend, path, refname string) error {
+	attrs, err := p.attributes(refname)
+	if err != nil {
+		return err
+	}
+	lockable, err := attrs.Lockable(path)
+	if err != nil {
+		return err
+	}
+	if !lockable {
+		return fmt.Errorf("%w: %s is not lockable, add the lockable attribute to it in .gitattributes", transfer.ErrForbidden, path)
+	}
+	return nil
+}
+
+// CheckUnlock implements transfer.LockPolicy.
+func (p *lockablePolicy) CheckUnlock(transfer.LockBackend, transfer.Lock) error {
+	return nil
+}
+
+// attributes returns the attributes of the tree refname points to.
+func (p *lockablePolicy) attributes(refname string) (*lfsgit.Attributes, error) {
+	var ref *plumbing.Reference
+	var err error
+	if refname != "" {
+		ref, err = p.repo.Reference(plumbing.ReferenceName(refname), true)
+	}
+	if refname == "" || errors.Is(err, plumbing.ErrReferenceNotFound) {
+		ref, err = p.repo.Head()
+	}
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// Empty repository, nothing is lockable yet.
+		return lfsgit.NewAttributes(&object.Tree{}), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %q: %w", refname, err)
+	}
+	if attrs, ok := p.attrs[ref.Hash()]; ok {
+		return attrs, nil
+	}
+	commit, err := p.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("error reading commit %s: %w", ref.Hash(), err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("error reading tree of commit %s: %w", ref.Hash(), err)
+	}
+	attrs := lfsgit.NewAttributes(tree)
+	p.attrs[ref.Hash()] = attrs
+	return attrs, nil
+}
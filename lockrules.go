@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	"github.com/git-lfs/wildmatch/v2"
+	formatcfg "github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+// Values of the locking setting of lock rules.
+const (
+	lockingAllowed   = "allowed"
+	lockingRequired  = "required"
+	lockingForbidden = "forbidden"
+)
+
+// lockRule is a rule of a lock policy file applying to the paths matching
+// its pattern.
+type lockRule struct {
+	pattern  string
+	match    *wildmatch.Wildmatch
+	allow    []string
+	maxLocks int
+	locking  string
+}
+
+// allows reports whether user may lock and unlock the paths of the rule.
+func (r *lockRule) allows(user string) bool {
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, a := range r.allow {
+		if a == user {
+			return true
+		}
+	}
+	return false
+}
+
+// lockRules is a lock policy read from a file in git config format:
+//
+//	[rule "*.psd"]
+//		allow = alice
+//		allow = bob
+//		maxLocks = 10
+//		locking = required
+//
+// The last rule whose pattern matches a path applies to it. Paths no rule
+// matches can be locked by anyone.
+type lockRules struct {
+	rules []*lockRule
+	user  string
+}
+
+var _ transfer.LockPolicy = &lockRules{}
+
+// loadLockRules reads the lock policy file at path on behalf of user.
+func loadLockRules(path, user string) (*lockRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock policy: %w", err)
+	}
+	defer f.Close() // nolint: errcheck
+	cfg := formatcfg.New()
+	if err := formatcfg.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("error parsing lock policy %s: %w", path, err)
+	}
+	p := &lockRules{user: user}
+	for _, sub := range cfg.Section("rule").Subsections {
+		rule := &lockRule{
+			pattern: sub.Name,
+			allow:   sub.OptionAll("allow"),
+			locking: lockingAllowed,
+		}
+		rule.match, err = compilePattern(sub.Name)
+		if err != nil {
+			return nil, err
+		}
+		if v := sub.Option("maxLocks"); v != "" {
+			rule.maxLocks, err = strconv.Atoi(v)
+			if err != nil || rule.maxLocks < 0 {
+				return nil, fmt.Errorf("invalid maxLocks for rule %q: %q", sub.Name, v)
+			}
+		}
+		if v := sub.Option("locking"); v != "" {
+			switch v {
+			case lockingAllowed, lockingRequired, lockingForbidden:
+				rule.locking = v
+			default:
+				return nil, fmt.Errorf("invalid locking for rule %q: %q", sub.Name, v)
+			}
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// compilePattern compiles a rule pattern. Patterns without a slash match file
+// names in any directory, like in .gitattributes.
+func compilePattern(pattern string) (w *wildmatch.Wildmatch, err error) {
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("invalid rule pattern %q", pattern)
+		}
+	}()
+	return wildmatch.NewWildmatch(pattern, wildmatch.Basename, wildmatch.GitAttributes), nil
+}
+
+// rule returns the rule applying to path, or nil if there's none.
+func (p *lockRules) rule(path string) *lockRule {
+	for i := len(p.rules) - 1; i >= 0; i-- {
+		if p.rules[i].match.Match(path) {
+			return p.rules[i]
+		}
+	}
+	return nil
+}
+
+// requiresLock returns the rule requiring path to be locked before being
+// pushed, if any.
+func (p *lockRules) requiresLock(path string) *lockRule {
+	if rule := p.rule(path); rule != nil && rule.locking == lockingRequired {
+		return rule
+	}
+	return nil
+}
+
+// CheckLock implements transfer.LockPolicy.
+func (p *lockRules) CheckLock(locks transfer.LockBackend, path, _ string) error {
+	rule := p.rule(path)
+	if rule == nil {
+		return nil
+	}
+	if rule.locking == lockingForbidden {
+		return fmt.Errorf("%w: locking %s is forbidden by rule %q", transfer.ErrForbidden, path, rule.pattern)
+	}
+	if !rule.allows(p.user) {
+		return fmt.Errorf("%w: %s may not lock %s per rule %q", transfer.ErrForbidden, p.user, path, rule.pattern)
+	}
+	if rule.maxLocks == 0 {
+		return nil
+	}
+	held := 0
+	var cursor string
+	for {
+		next, err := locks.Range(cursor, 100, func(l transfer.Lock) error {
+			if l.OwnerName() == p.user && p.rule(l.Path()) == rule {
+				held++
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error listing locks: %w", err)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if held >= rule.maxLocks {
+		return fmt.Errorf("%w: %s already holds %d locks, the maximum per rule %q", transfer.ErrForbidden, p.user, held, rule.pattern)
+	}
+	return nil
+}
+
+// CheckUnlock implements transfer.LockPolicy. Owners may always release their
+// own locks.
+func (p *lockRules) CheckUnlock(_ transfer.LockBackend, lock transfer.Lock) error {
+	if lock.OwnerName() == p.user {
+		return nil
+	}
+	rule := p.rule(lock.Path())
+	if rule == nil || rule.allows(p.user) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s may not unlock %s per rule %q", transfer.ErrForbidden, p.user, lock.Path(), rule.pattern)
+}
+
+// lockRules reads the lock policy file configured for the repository. It
+// returns nil if there's none.
+func (r *repository) lockRules() (*lockRules, error) {
+	path := r.config.String("lockpolicy", "")
+	if path == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(r.gitdir, path)
+	}
+	user, err := r.identity()
+	if err != nil {
+		return nil, err
+	}
+	return loadLockRules(path, user)
+}
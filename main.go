@@ -35,11 +35,16 @@ func main() {
 		os.Exit(1)
 	}
 	if err := Command(os.Stdin, os.Stdout, os.Stderr, args[1:]...); err != nil {
-		fmt.Fprint(os.Stderr, Usage())
-		fmt.Fprintln(os.Stderr)
+		if errors.Is(err, errPushRejected) {
+			os.Exit(1)
+		}
+		if isUsageError(err) {
+			fmt.Fprint(os.Stderr, Usage())
+			fmt.Fprintln(os.Stderr)
+		}
 		fmt.Fprintln(os.Stderr, err)
 		switch {
-		case errors.Is(err, transfer.ErrConflict):
+		case errors.Is(err, transfer.ErrConflict), errors.Is(err, errProblemsFound):
 			os.Exit(1)
 		default:
 			os.Exit(2)
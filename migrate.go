@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+)
+
+const migrateLayoutOperation = "migrate-layout"
+
+// migrateLayout moves the repository's objects to another on-disk layout.
+//
+// New sessions are switched to the new layout first, with the old one kept
+// as a fallback for lookups, so the repository can be served throughout.
+// Sessions started before the switch find moved objects as every backend
+// falls back to the other layouts when an object is missing. They may still
+// upload objects with the old layout though, so once they have ended, running
+// the migration again with --finish moves any stragglers, removes the
+// directories left empty and drops the fallback. Objects whose new path
+// already holds different content are kept in place and reported; the
+// migration can't be finished until they are dealt with.
+func migrateLayout(w io.Writer, repo *repository, args ...string) error {
+	flags := flag.NewFlagSet(migrateLayoutOperation, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	finish := flags.Bool("finish", false, "stop looking up objects in the previous layout")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if flags.NArg() != 1 {
+		return usageErrorf("%s: expected a layout name", migrateLayoutOperation)
+	}
+	to, err := local.ParseLayout(flags.Arg(0))
+	if err != nil {
+		return usageError{err}
+	}
+	current, err := local.ParseLayout(repo.config.String("layout", local.DefaultLayout.Name()))
+	if err != nil {
+		return err
+	}
+	previous := repo.config.String("previouslayout", "")
+	from := current
+	switch {
+	case current.Name() == to.Name() && previous == "":
+		fmt.Fprintf(w, "already using the %s layout\n", to.Name())
+		return nil
+	case current.Name() == to.Name():
+		from, err = local.ParseLayout(previous)
+		if err != nil {
+			return err
+		}
+	case previous != "":
+		return fmt.Errorf("a migration from the %s layout is in progress, finish it first", previous)
+	default:
+		if err := repo.config.Set("previouslayout", current.Name()); err != nil {
+			return err
+		}
+		if err := repo.config.Set("layout", to.Name()); err != nil {
+			return err
+		}
+	}
+	lb := local.New(repo.lfsPath, repo.umask, &repo.now, local.WithLayout(to, from))
+	kept := 0
+	moved, err := lb.MigrateLayout(from, *finish, func(oid, path string) {
+		fmt.Fprintf(w, "kept %s: object %s differs from the copy in the %s layout\n", path, oid, to.Name())
+		kept++
+	})
+	fmt.Fprintf(w, "moved %d objects from the %s layout to the %s layout\n", moved, from.Name(), to.Name())
+	if err != nil {
+		return err
+	}
+	if kept > 0 && *finish {
+		return fmt.Errorf("%w: %s kept %d conflicting objects in the %s layout, check them with fsck", errProblemsFound, migrateLayoutOperation, kept, from.Name())
+	}
+	if !*finish {
+		fmt.Fprintf(w, "run %s --finish %s once running sessions have ended\n", migrateLayoutOperation, to.Name())
+		return nil
+	}
+	if err := repo.config.Unset("previouslayout"); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "migration finished")
+	return nil
+}
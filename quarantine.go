@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/lfsgit"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	"github.com/git-lfs/git-lfs/v3/tools/humanize"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const (
+	promoteOperation         = "promote"
+	pruneQuarantineOperation = "prune-quarantine"
+)
+
+// defaultQuarantineExpiry is how long an upload quarantine is kept after
+// the last object was written to it.
+const defaultQuarantineExpiry = 24 * time.Hour
+
+// promote moves the objects referenced by a push out of the upload
+// quarantines into the store. It is meant to run from the post-receive hook
+// and reads the ref updates from r.
+func promote(r io.Reader, w io.Writer, repo *repository, args ...string) error {
+	if len(args) != 0 {
+		return usageErrorf("%s takes no arguments", promoteOperation)
+	}
+	if kind := repo.config.String("backend", "local"); kind != "local" {
+		return fmt.Errorf("%s is not supported by the %s backend", promoteOperation, kind)
+	}
+	updates, err := readRefUpdates(r)
+	if err != nil {
+		return err
+	}
+	gr, err := repo.git()
+	if err != nil {
+		return err
+	}
+	// The refs already point to the pushed commits, so only hide what the
+	// updated refs pointed to before and what the other refs point to.
+	updated := map[plumbing.Hash]struct{}{}
+	var hidden []plumbing.Hash
+	for _, u := range updates {
+		updated[u.New] = struct{}{}
+		if !u.Old.IsZero() {
+			hidden = append(hidden, u.Old)
+		}
+	}
+	tips, err := lfsgit.RefHashes(gr.Storer)
+	if err != nil {
+		return err
+	}
+	for _, h := range tips {
+		if _, ok := updated[h]; !ok {
+			hidden = append(hidden, h)
+		}
+	}
+	walker := lfsgit.NewWalker(gr.Storer)
+	if err := walker.Hide(hidden...); err != nil {
+		return err
+	}
+	pushed := map[string]struct{}{}
+	err = walker.Pointers(pushedCommits(updates), func(e lfsgit.Entry) error {
+		pushed[e.Oid] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(pushed) == 0 {
+		return nil
+	}
+	lb, err := repo.localBackend()
+	if err != nil {
+		return err
+	}
+	// Uploads only count as done once their objects leave the quarantine.
+	h, err := repo.hooks()
+	if err != nil {
+		return err
+	}
+	n, err := lb.Promote(func(oid string) bool {
+		_, ok := pushed[oid]
+		return ok
+	}, func(oid string, size int64) {
+		if h == nil {
+			return
+		}
+		e := transfer.Event{
+			Operation: transfer.UploadOperation,
+			Command:   "put-object",
+			Oid:       oid,
+			Size:      size,
+			Status:    transfer.StatusOK,
+			Time:      time.Now(),
+		}
+		if err := h.runEvent(postUploadHook, e); err != nil {
+			logger.Log("failed to run hook", "hook", postUploadHook, "oid", oid, "err", err)
+		}
+	})
+	if n > 0 {
+		fmt.Fprintf(w, "git-lfs-transfer: promoted %d objects\n", n)
+	}
+	return err
+}
+
+// pruneQuarantine removes the upload quarantines left behind by pushes that
+// were rejected or never happened.
+func pruneQuarantine(w io.Writer, repo *repository, args ...string) error {
+	flags := flag.NewFlagSet(pruneQuarantineOperation, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	expire := flags.Duration("expire", defaultQuarantineExpiry, "minimum age of removed quarantines")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if flags.NArg() != 0 {
+		return usageErrorf("%s: unexpected arguments: %v", pruneQuarantineOperation, flags.Args())
+	}
+	if kind := repo.config.String("backend", "local"); kind != "local" {
+		return fmt.Errorf("%s is not supported by the %s backend", pruneQuarantineOperation, kind)
+	}
+	lb, err := repo.localBackend()
+	if err != nil {
+		return err
+	}
+	var count, total int64
+	err = lb.PruneQuarantine(repo.now.Add(-*expire), func(session string, size int64) {
+		count++
+		total += size
+		fmt.Fprintf(w, "removed %s %d\n", session, size)
+	})
+	fmt.Fprintf(w, "removed %d quarantines, reclaimed %s\n", count, humanize.FormatBytes(uint64(total)))
+	return err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+	"github.com/charmbracelet/git-lfs-transfer/internal/throttle"
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+// hostRateStateDir is the name of the directory in the system's temporary
+// directory where the host rate limits are shared by default.
+const hostRateStateDir = "git-lfs-transfer-ratelimit"
+
+// rateStateDir returns the directory where the sessions of the current system
+// user share the state of rate limits: a directory named after the user's uid
+// in `lfstransfer.rateStateDir`. Unless another one is configured, that's
+// `lfs/ratelimit`, or with hostWide a directory in the system's temporary
+// directory shared by every repository of the host. Each user gets their own,
+// since state files can only be trusted if no one else can write to them. It's
+// an error if the directory isn't private to the user, rather than limiting
+// each session on its own.
+func (r *repository) rateStateDir(hostWide bool) (string, error) {
+	// Shared repositories let every user add their own directory.
+	base, mode := filepath.Join(r.lfsPath, "ratelimit"), os.ModePerm&^r.umask
+	if hostWide {
+		// As does the host directory, where they may only remove theirs.
+		base, mode = filepath.Join(os.TempDir(), hostRateStateDir), os.ModePerm|os.ModeSticky
+	}
+	base = r.config.String("ratestatedir", base)
+	if _, err := os.Stat(base); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(base, os.ModePerm); err != nil {
+			return "", err
+		}
+		// Another user may have created it meanwhile.
+		if err := os.Chmod(base, mode); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return "", err
+		}
+	}
+	name := strconv.Itoa(os.Geteuid())
+	if os.Geteuid() < 0 {
+		// No uids on this platform.
+		user, err := local.CurrentUser()
+		if err != nil {
+			return "", fmt.Errorf("error getting current user: %w", err)
+		}
+		name = url.PathEscape(user)
+	}
+	dir := filepath.Join(base, name)
+	if err := throttle.PrepareDir(dir); err != nil {
+		return "", fmt.Errorf("unusable rate limit state directory: %w", err)
+	}
+	return dir, nil
+}
+
+// sharedBucket returns a bucket sharing its state with the other sessions of
+// the user through the file name of dir, logging if it stops being usable.
+func sharedBucket(dir, name string, rate, burst int64) *throttle.SharedBucket {
+	path := filepath.Join(dir, name)
+	return throttle.NewSharedBucket(path, rate, burst, func(err error) {
+		logger.Log("rate limit state unusable, limiting this session only", "path", path, "err", err)
+	})
+}
+
+// rateLimiters returns the bandwidth limits configured for sessions of the
+// given operation: one for the session itself, and one shared through a state
+// file by the sessions of the user that use the same state directory, those of
+// the host by default.
+func (r *repository) rateLimiters(op string) ([]transfer.RateLimiter, error) {
+	burst, err := r.config.Size("rateburst", 0)
+	if err != nil {
+		return nil, err
+	}
+	var limiters []transfer.RateLimiter
+	rate, err := r.config.Size(op+"rate", 0)
+	if err != nil {
+		return nil, err
+	}
+	if rate > 0 {
+		limiters = append(limiters, throttle.NewBucket(rate, burst))
+	}
+	hostRate, err := r.config.Size("host"+op+"rate", 0)
+	if err != nil {
+		return nil, err
+	}
+	if hostRate > 0 {
+		dir, err := r.rateStateDir(true)
+		if err != nil {
+			return nil, err
+		}
+		limiters = append(limiters, sharedBucket(dir, op+"-rate", hostRate, burst))
+	}
+	return limiters, nil
+}
+
+// requestTokens is the number of bucket tokens a request takes, so that
+// rates under one request per second can be represented.
+const requestTokens = 1000
+
+// requestLimiter limits how often an identity may send each command. The
+// limits are shared by the sessions of the user through state files, one per
+// identity and command.
+type requestLimiter struct {
+	buckets map[string]*throttle.SharedBucket
+}
+
+var _ transfer.RequestLimiter = &requestLimiter{}
+
+// Allow implements transfer.RequestLimiter.
+func (l *requestLimiter) Allow(command string) time.Duration {
+	return l.buckets[command].Allow(requestTokens)
+}
+
+// requestCommands are the commands whose rate can be limited.
+var requestCommands = []string{"batch", "put-object", "verify-object", "get-object", "lock", "list-lock", "unlock"}
+
+// requestLimiter returns the request rate limits configured for the
+// repository, or nil if there are none. Rates are numbers of requests per
+// minute, set for every command by `lfstransfer.requestRate` and for a given
+// one by `lfstransfer.<command>.requestRate`.
+func (r *repository) requestLimiter() (transfer.RequestLimiter, error) {
+	def, err := r.requestCount("requestrate")
+	if err != nil {
+		return nil, err
+	}
+	burst, err := r.requestCount("requestburst")
+	if err != nil {
+		return nil, err
+	}
+	var identity, dir string
+	l := &requestLimiter{buckets: map[string]*throttle.SharedBucket{}}
+	for _, cmd := range requestCommands {
+		rate, err := r.requestCount(cmd + ".requestrate")
+		if err != nil {
+			return nil, err
+		}
+		if rate == 0 {
+			rate = def
+		}
+		if rate == 0 {
+			continue
+		}
+		if identity == "" {
+			if identity, err = r.identity(); err != nil {
+				return nil, err
+			}
+			if dir, err = r.rateStateDir(false); err != nil {
+				return nil, err
+			}
+		}
+		capacity := burst
+		if capacity == 0 {
+			capacity = rate
+		}
+		name := "requests-" + url.PathEscape(identity) + "-" + cmd
+		perSecond := max(rate*requestTokens/int64(time.Minute/time.Second), 1)
+		l.buckets[cmd] = sharedBucket(dir, name, perSecond, capacity*requestTokens)
+	}
+	if len(l.buckets) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// requestCount returns key as a number of requests, or zero if it's not set.
+func (r *repository) requestCount(key string) (int64, error) {
+	v := r.config.String(key, "")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number of requests for %s.%s: %q", configSection, key, v)
+	}
+	return n, nil
+}
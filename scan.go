@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+)
+
+// clamdDialTimeout is how long to wait for clamd to accept a connection.
+const clamdDialTimeout = 10 * time.Second
+
+// clamdChunkSize is the size of the chunks objects are streamed to clamd in.
+const clamdChunkSize = 64 << 10
+
+// defaultScanTimeout is how long scanning an object may take.
+const defaultScanTimeout = 5 * time.Minute
+
+// clamdScanner scans objects with a clamd daemon, streaming them with the
+// INSTREAM command so that clamd needs no access to the repository.
+type clamdScanner struct {
+	network string
+	address string
+	// maxSize is the size above which objects aren't scanned, if positive.
+	maxSize int64
+	// timeout is how long a scan may take, if positive.
+	timeout time.Duration
+}
+
+var _ transfer.Scanner = &clamdScanner{}
+
+// newClamdScanner returns a scanner using the clamd daemon listening at
+// address, the path of a Unix socket or a TCP host:port, skipping objects
+// larger than maxSize if it's positive and giving up on scans taking longer
+// than timeout if it's positive.
+func newClamdScanner(address string, maxSize int64, timeout time.Duration) *clamdScanner {
+	if filepath.IsAbs(address) {
+		return &clamdScanner{network: "unix", address: address, maxSize: maxSize, timeout: timeout}
+	}
+	return &clamdScanner{network: "tcp", address: address, maxSize: maxSize, timeout: timeout}
+}
+
+// Scan implements transfer.Scanner. Objects over clamd's StreamMaxLength are
+// refused as too large, since they can't be scanned.
+func (s *clamdScanner) Scan(oid, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if s.maxSize > 0 && info.Size() > s.maxSize {
+		logger.Log("object too large to scan with clamd", "oid", oid, "size", info.Size())
+		return nil
+	}
+	conn, err := net.DialTimeout(s.network, s.address, clamdDialTimeout)
+	if err != nil {
+		return fmt.Errorf("error connecting to clamd: %w", err)
+	}
+	defer conn.Close() // nolint: errcheck
+	if s.timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+			return err
+		}
+	}
+	sendErr := sendStream(conn, f)
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) && sendErr == nil {
+		return fmt.Errorf("error reading clamd reply: %w", err)
+	}
+	// Replies are "stream: OK", "stream: <signature> FOUND" or
+	// "<message> ERROR". clamd closes the connection as soon as a stream
+	// goes over StreamMaxLength, so its reply may cut the stream short.
+	reply = strings.TrimPrefix(strings.TrimRight(reply, "\x00\n"), "stream: ")
+	switch {
+	case strings.Contains(reply, "size limit exceeded"):
+		return fmt.Errorf("%w: object %s is larger than clamd can scan", transfer.ErrTooLarge, oid)
+	case sendErr != nil:
+		return sendErr
+	case reply == "OK":
+		return nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return fmt.Errorf("%w: object %s rejected by clamd: %s", transfer.ErrForbidden, oid, reply)
+	default:
+		return fmt.Errorf("clamd failed to scan object %s: %s", oid, reply)
+	}
+}
+
+// sendStream sends the INSTREAM command with the data of r to clamd.
+func sendStream(conn net.Conn, r io.Reader) error {
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return fmt.Errorf("error sending object to clamd: %w", err)
+	}
+	buf := make([]byte, clamdChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := binary.Write(w, binary.BigEndian, uint32(n)); err != nil {
+				return fmt.Errorf("error sending object to clamd: %w", err)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return fmt.Errorf("error sending object to clamd: %w", err)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// A zero-length chunk ends the stream.
+	if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
+		return fmt.Errorf("error sending object to clamd: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error sending object to clamd: %w", err)
+	}
+	return nil
+}
+
+// execScanner scans objects by running a command.
+type execScanner struct {
+	command string
+	// timeout is how long a scan may take, if positive.
+	timeout time.Duration
+}
+
+var _ transfer.Scanner = &execScanner{}
+
+// Scan implements transfer.Scanner. The command is run by the shell with the
+// path of the object as argument and its ID in LFS_OID. Objects are rejected
+// when it exits with an error, giving the first line of its output as the
+// reason. A command running longer than the timeout is killed, and the upload
+// fails without the object being rejected.
+func (s *execScanner) Scan(oid, path string) error {
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.command+` "$@"`, s.command, path)
+	cmd.Env = append(os.Environ(), "LFS_OID="+oid)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Don't wait for background processes still holding the output.
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("the scan command timed out after %s scanning object %s", s.timeout, oid)
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		reason, _, _ := strings.Cut(strings.TrimSpace(out.String()), "\n")
+		if reason == "" {
+			reason = exit.Error()
+		}
+		return fmt.Errorf("%w: object %s rejected by the scan command: %s", transfer.ErrForbidden, oid, reason)
+	}
+	if err != nil {
+		return fmt.Errorf("error running the scan command: %w", err)
+	}
+	return nil
+}
+
+// scanners returns the scanners configured for the repository's uploads.
+func (r *repository) scanners() ([]transfer.Scanner, error) {
+	var scanners []transfer.Scanner
+	timeout, err := r.config.Duration("scantimeout", defaultScanTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if address := r.config.String("clamd", ""); address != "" {
+		maxSize, err := r.config.Size("scanmaxsize", 0)
+		if err != nil {
+			return nil, err
+		}
+		scanners = append(scanners, newClamdScanner(address, maxSize, timeout))
+	}
+	if command := r.config.String("scancommand", ""); command != "" {
+		scanners = append(scanners, &execScanner{command: command, timeout: timeout})
+	}
+	return scanners, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/local"
+	"github.com/charmbracelet/git-lfs-transfer/internal/throttle"
+	"github.com/git-lfs/git-lfs/v3/tools/humanize"
+)
+
+const scrubOperation = "scrub"
+
+// scrubSummary is the last record written by scrub.
+type scrubSummary struct {
+	Kind string `json:"type"`
+	local.ScrubStatus
+}
+
+// scrub re-hashes the stored objects at a bounded rate, repairing corrupt ones
+// from the configured replicas, and writes the problems found as JSON lines.
+// It resumes where the previous scrub stopped.
+func scrub(w io.Writer, repo *repository, args ...string) error {
+	flags := flag.NewFlagSet(scrubOperation, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	rate := flags.String("rate", repo.config.String("scrubrate", ""), "maximum read rate per second, e.g. 50MB")
+	maxTime := flags.Duration("max-time", 0, "stop after this long, the next scrub resumes from there")
+	restart := flags.Bool("restart", false, "start over instead of resuming the previous scrub")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if flags.NArg() != 0 {
+		return usageErrorf("%s: unexpected arguments: %v", scrubOperation, flags.Args())
+	}
+	if kind := repo.config.String("backend", "local"); kind != "local" {
+		return fmt.Errorf("%s is not supported by the %s backend", scrubOperation, kind)
+	}
+	var limit *throttle.Bucket
+	if *rate != "" {
+		n, err := humanize.ParseBytes(*rate)
+		if err != nil {
+			return fmt.Errorf("%s: invalid rate %q", scrubOperation, *rate)
+		}
+		limit = throttle.NewBucket(int64(n), 0)
+	}
+	opts, err := backendOptions(repo.config)
+	if err != nil {
+		return err
+	}
+	// Repaired objects go straight into the store, even when uploads are
+	// quarantined.
+	lb := local.New(repo.lfsPath, repo.umask, &repo.now, opts...)
+	replicas, err := repo.replicas()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	st, err := lb.Scrub(local.ScrubOptions{
+		Limit:       limit,
+		MaxDuration: *maxTime,
+		Restart:     *restart,
+		Replicas:    replicas,
+	}, func(p local.Problem) error {
+		return enc.Encode(p)
+	})
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(scrubSummary{Kind: "summary", ScrubStatus: st}); err != nil {
+		return err
+	}
+	if left := st.Problems - st.Repaired; left > 0 {
+		return fmt.Errorf("%w: %s found %d problems that couldn't be repaired", errProblemsFound, scrubOperation, left)
+	}
+	return nil
+}
+
+// replicas returns the replicas configured for the repository, other LFS
+// directories holding copies of its objects. Their objects are looked up in
+// every layout, like any backend's, starting with the repository's own.
+func (r *repository) replicas() ([]local.Replica, error) {
+	layout, err := local.ParseLayout(r.config.String("layout", local.DefaultLayout.Name()))
+	if err != nil {
+		return nil, err
+	}
+	var replicas []local.Replica
+	for _, path := range r.config.Strings("scrubreplica") {
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("%s.scrubReplica must be an absolute path: %q", configSection, path)
+		}
+		replicas = append(replicas, local.Replica{
+			Name:    path,
+			Backend: local.New(path, r.umask, &r.now, local.WithLayout(layout)),
+		})
+	}
+	return replicas, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/dedup"
+)
+
+const statsOperation = "stats"
+
+// stats prints the deduplication statistics of the repository.
+func stats(w io.Writer, repo *repository, args ...string) error {
+	if len(args) != 0 {
+		return usageErrorf("%s takes no arguments", statsOperation)
+	}
+	backend, err := repo.backend()
+	if err != nil {
+		return err
+	}
+	db, ok := backend.(*dedup.DedupBackend)
+	if !ok {
+		return fmt.Errorf("%s requires the dedup backend", statsOperation)
+	}
+	s, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "objects %d\n", s.Objects)
+	fmt.Fprintf(w, "chunks %d\n", s.Chunks)
+	fmt.Fprintf(w, "logical-size %d\n", s.LogicalSize)
+	fmt.Fprintf(w, "stored-size %d\n", s.StoredSize)
+	fmt.Fprintf(w, "ratio %.2f\n", s.Ratio())
+	return nil
+}
@@ -16,8 +16,17 @@ const (
 	PathKey      = "path"
 	LimitKey     = "limit"
 	CursorKey    = "cursor"
+	VerifyKey    = "verify"
 )
 
+// RetryAfterKey is the status argument telling clients how many seconds to
+// wait before retrying a request refused for going over a rate limit.
+const RetryAfterKey = "retry-after"
+
+// VerifyDeep is the value of the verify argument of verify-object requests
+// asking for the object's contents to be hashed, not only its size checked.
+const VerifyDeep = "deep"
+
 // ParseArgs parses the given args.
 func ParseArgs(parts []string) (Args, error) {
 	args := make(Args, 0)
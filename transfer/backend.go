@@ -41,3 +41,27 @@ type LockBackend interface {
 	FromID(id string) (Lock, error)
 	Range(cursor string, limit int, iter func(Lock) error) (string, error)
 }
+
+// RepairFlagger is implemented by backends that can record that an object was
+// found to be corrupt, so that it can be repaired.
+type RepairFlagger interface {
+	FlagForRepair(oid string, reason error) error
+}
+
+// VerificationCache is implemented by backends that remember which objects
+// were recently verified, so that downloads don't hash them every time.
+type VerificationCache interface {
+	// Verified reports whether the object was verified recently enough to
+	// be trusted.
+	Verified(oid string) bool
+	// MarkVerified records that the object was just verified.
+	MarkVerified(oid string) error
+}
+
+// ObjectStater is implemented by backends that can look objects up without
+// the checks a batch request runs for its operation, such as upload quotas.
+type ObjectStater interface {
+	// StatObject returns the size of the stored object, or an error
+	// wrapping fs.ErrNotExist if it isn't stored.
+	StatObject(oid string) (int64, error)
+}
@@ -25,4 +25,13 @@ var (
 	ErrUnauthorized = errors.New("unauthorized")
 	// ErrUnauthorized is the forbidden error.
 	ErrForbidden = errors.New("forbidden")
+	// ErrTooLarge is the too large error, returned when an upload doesn't fit
+	// in a quota.
+	ErrTooLarge = errors.New("too large")
+	// ErrInsufficientStorage is the insufficient storage error, returned when
+	// the server is running out of disk space.
+	ErrInsufficientStorage = errors.New("insufficient storage")
+	// ErrTooManyRequests is the too many requests error, returned when a
+	// client goes over its request rate limit.
+	ErrTooManyRequests = errors.New("too many requests")
 )
@@ -0,0 +1,68 @@
+package transfer
+
+import (
+	"time"
+)
+
+// Event describes a request served by a processor.
+type Event struct {
+	// Operation is the operation of the session, upload or download.
+	Operation string
+	// Command is the command of the request.
+	Command string
+	// Oid is the object ID of put-object and get-object requests.
+	Oid string
+	// Size is the size of the object transferred, or the total size of the
+	// objects of a batch request.
+	Size int64
+	// Objects are the objects of a batch request.
+	Objects []Pointer
+	// Path is the path locked or unlocked.
+	Path string
+	// LockID is the ID of the lock created or removed.
+	LockID string
+	// Status is the status code the request was answered with.
+	Status uint32
+	// Err is the error the request failed with, if any. A download whose
+	// data was cut short has an error besides its successful status.
+	Err error
+	// Time is when the request was received.
+	Time time.Time
+	// Duration is how long it took to serve the request, including the
+	// transfer of the object.
+	Duration time.Duration
+}
+
+// EventSink records the requests served by a processor.
+type EventSink interface {
+	// Record records the event of a request once it has been answered.
+	Record(Event) error
+}
+
+// eventCommands are the commands whose requests are recorded by event sinks.
+var eventCommands = map[string]bool{
+	batchCommand:     true,
+	putObjectCommand: true,
+	getObjectCommand: true,
+	lockCommand:      true,
+	unlockCommand:    true,
+}
+
+// record passes the event of the request just answered with status to the
+// event sinks. err is the error the request failed with, if any.
+func (p *Processor) record(status Status, err error) {
+	if len(p.eventSinks) == 0 || !eventCommands[p.event.Command] {
+		return
+	}
+	e := p.event
+	e.Duration = time.Since(e.Time)
+	if status != nil {
+		e.Status = status.Code()
+	}
+	e.Err = err
+	for _, sink := range p.eventSinks {
+		if err := sink.Record(e); err != nil {
+			p.logger.Log("failed to record event", "command", e.Command, "err", err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package transfer
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -77,3 +78,26 @@ func (v *VerifyingReader) Read(p []byte) (int, error) {
 	}
 	return n, err
 }
+
+// verifyingDownload is the reader of a verified download. done is called once
+// with the result of the verification when the object has been read.
+type verifyingDownload struct {
+	*VerifyingReader
+	io.Closer
+	done func(error)
+}
+
+// Read reads from the VerifyingReader and reports the verification result
+// at EOF.
+func (v *verifyingDownload) Read(p []byte) (int, error) {
+	n, err := v.VerifyingReader.Read(p)
+	if err != nil && v.done != nil && (err == io.EOF || errors.Is(err, ErrCorruptData)) {
+		if err == io.EOF {
+			v.done(nil)
+		} else {
+			v.done(err)
+		}
+		v.done = nil
+	}
+	return n, err
+}
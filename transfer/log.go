@@ -12,3 +12,8 @@ var _ Logger = (*noopLogger)(nil)
 
 // Log implements Logger.
 func (*noopLogger) Log(string, ...interface{}) {}
+
+// NopLogger returns a logger that discards everything.
+func NopLogger() Logger {
+	return new(noopLogger)
+}
@@ -98,7 +98,10 @@ func (p *Pktline) SendStatus(status Status) error {
 		}
 		w := p.Writer()
 		if _, err := io.Copy(w, r); err != nil {
+			// Don't terminate the data with a flush packet, so that
+			// the client doesn't take it for the whole object.
 			p.logger.Log("failed to copy reader", "err", err)
+			return err
 		}
 		defer p.logger.Log("done copying")
 		return w.Flush()
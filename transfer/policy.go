@@ -0,0 +1,21 @@
+package transfer
+
+// LockPolicy decides whether locks may be created and removed. Policies
+// return errors wrapping ErrForbidden to refuse a request, which is then
+// answered with a 403 status carrying the error message.
+type LockPolicy interface {
+	// CheckLock checks whether path may be locked on refname. Refname can be
+	// empty.
+	CheckLock(locks LockBackend, path, refname string) error
+	// CheckUnlock checks whether lock may be removed.
+	CheckUnlock(locks LockBackend, lock Lock) error
+}
+
+// UploadPolicy decides whether objects may be uploaded. Policies return errors
+// wrapping ErrForbidden to refuse an object, which is then answered with a 403
+// status carrying the error message.
+type UploadPolicy interface {
+	// CheckUpload checks whether the object oid of the given size may be
+	// uploaded. It's called before the object's data is read.
+	CheckUpload(oid string, size int64) error
+}
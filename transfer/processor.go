@@ -9,25 +9,92 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Processor is a transfer processor.
 type Processor struct {
-	handler *Pktline
-	backend Backend
-	logger  Logger
+	handler         *Pktline
+	backend         Backend
+	logger          Logger
+	lockPolicies    []LockPolicy
+	uploadPolicies  []UploadPolicy
+	verifyDownloads bool
+	rateLimiters    []RateLimiter
+	requestLimiters []RequestLimiter
+	eventSinks      []EventSink
+	event           Event
+}
+
+// ProcessorOption configures a transfer processor.
+type ProcessorOption func(*Processor)
+
+// WithLockPolicy makes the processor check lock and unlock requests against
+// the given policy. Requests must satisfy every policy given.
+func WithLockPolicy(policy LockPolicy) ProcessorOption {
+	return func(p *Processor) {
+		p.lockPolicies = append(p.lockPolicies, policy)
+	}
+}
+
+// WithUploadPolicy makes the processor check put-object requests against the
+// given policy. Requests must satisfy every policy given.
+func WithUploadPolicy(policy UploadPolicy) ProcessorOption {
+	return func(p *Processor) {
+		p.uploadPolicies = append(p.uploadPolicies, policy)
+	}
+}
+
+// WithDownloadVerification makes the processor hash objects as they are
+// downloaded. When an object doesn't match its ID, the transfer is aborted
+// instead of being completed, and the object is flagged for repair if the
+// backend implements RepairFlagger. Backends implementing VerificationCache
+// can spare hashing objects verified recently.
+func WithDownloadVerification() ProcessorOption {
+	return func(p *Processor) {
+		p.verifyDownloads = true
+	}
+}
+
+// WithRateLimit limits the rate objects are uploaded and downloaded at.
+// Transfers must satisfy every limiter given.
+func WithRateLimit(limiters ...RateLimiter) ProcessorOption {
+	return func(p *Processor) {
+		p.rateLimiters = append(p.rateLimiters, limiters...)
+	}
+}
+
+// WithRequestLimit refuses requests going over the rate limiters allow with a
+// 429 status telling the client when to retry. Requests must satisfy every
+// limiter given.
+func WithRequestLimit(limiters ...RequestLimiter) ProcessorOption {
+	return func(p *Processor) {
+		p.requestLimiters = append(p.requestLimiters, limiters...)
+	}
+}
+
+// WithEventSink records the batch, put-object, get-object, lock and unlock
+// requests served by the processor to sink.
+func WithEventSink(sink EventSink) ProcessorOption {
+	return func(p *Processor) {
+		p.eventSinks = append(p.eventSinks, sink)
+	}
 }
 
 // NewProcessor creates a new transfer processor.
-func NewProcessor(line *Pktline, backend Backend, logger Logger) *Processor {
+func NewProcessor(line *Pktline, backend Backend, logger Logger, opts ...ProcessorOption) *Processor {
 	if logger == nil {
 		logger = new(noopLogger)
 	}
-	return &Processor{
+	p := &Processor{
 		handler: line,
 		backend: backend,
 		logger:  logger,
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
 // Version returns the version of the transfer protocol.
@@ -84,6 +151,9 @@ func (p *Processor) ReadBatch(op string, args Args) ([]BatchItem, error) {
 			},
 			Args: oidArgs,
 		}
+		if !item.IsValid() {
+			return nil, fmt.Errorf("%w: invalid object %q", ErrParseError, line)
+		}
 		items = append(items, item)
 	}
 	p.logger.Log("batch items", "items", items)
@@ -111,6 +181,8 @@ func (p *Processor) BatchData(op string, presentAction string, missingAction str
 	}
 	oids := make([]string, 0)
 	for _, item := range batch {
+		p.event.Objects = append(p.event.Objects, item.Pointer)
+		p.event.Size += item.Size
 		action := missingAction
 		if item.Present {
 			action = presentAction
@@ -147,6 +219,15 @@ func SizeFromArgs(args Args) (int64, error) {
 	return n, nil
 }
 
+// checkOid returns an error if oid isn't a valid object ID. Backends use
+// object IDs to name files, so anything else is refused before reaching them.
+func checkOid(oid string) error {
+	if !(Pointer{Oid: oid}).IsValid() {
+		return fmt.Errorf("%w: invalid object ID %q", ErrParseError, oid)
+	}
+	return nil
+}
+
 // PutObject writes an object ID to the transfer protocol.
 func (p *Processor) PutObject(oid string) (Status, error) {
 	ar, err := p.handler.ReadPacketListToDelim()
@@ -161,10 +242,28 @@ func (p *Processor) PutObject(oid string) (Status, error) {
 	if err != nil {
 		return nil, err
 	}
-	r := p.handler.Reader()
+	p.event.Size = expectedSize
+	var r io.Reader = p.handler.Reader()
+	if len(p.rateLimiters) > 0 {
+		r = p.limitRate(r)
+	}
+	if err := checkOid(oid); err != nil {
+		io.Copy(io.Discard, r) // nolint: errcheck
+		return nil, err
+	}
+	for _, policy := range p.uploadPolicies {
+		if err := policy.CheckUpload(oid, expectedSize); err != nil {
+			p.logger.Log("upload refused by policy", "oid", oid, "err", err)
+			io.Copy(io.Discard, r) // nolint: errcheck
+			return nil, err
+		}
+	}
 	rdr := NewVerifyingReader(r, sha256.New(), oid, expectedSize)
 	err = p.backend.Upload(oid, expectedSize, rdr, args)
 	if err != nil {
+		// Skip the rest of the object so that the next command can be
+		// read.
+		io.Copy(io.Discard, r) // nolint: errcheck
 		return nil, err
 	}
 	return SuccessStatus(), nil
@@ -184,6 +283,9 @@ func (p *Processor) VerifyObject(oid string) (Status, error) {
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", ErrParseError, err)
 	}
+	if err := checkOid(oid); err != nil {
+		return nil, err
+	}
 	return p.backend.Verify(oid, size, args)
 }
 
@@ -197,6 +299,9 @@ func (p *Processor) GetObject(oid string) (Status, error) {
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", ErrParseError, err)
 	}
+	if err := checkOid(oid); err != nil {
+		return nil, err
+	}
 	r, size, err := p.backend.Download(oid, args)
 	if errors.Is(err, fs.ErrNotExist) {
 		return NewStatus(StatusNotFound, fmt.Sprintf("object %s not found", oid)), nil
@@ -204,9 +309,45 @@ func (p *Processor) GetObject(oid string) (Status, error) {
 	if err != nil {
 		return nil, err
 	}
+	p.event.Size = size
+	if p.verifyDownloads {
+		r = p.verifyDownload(oid, size, r)
+	}
+	if len(p.rateLimiters) > 0 {
+		r = rateLimitedReadCloser{p.limitRate(r), r}
+	}
 	return NewSuccessStatusWithReader(r, fmt.Sprintf("size=%d", size)), nil
 }
 
+// verifyDownload wraps the reader of a download so that it fails if the
+// object doesn't match its ID, unless the backend verified it recently.
+func (p *Processor) verifyDownload(oid string, size int64, r io.ReadCloser) io.ReadCloser {
+	cache, _ := p.backend.(VerificationCache)
+	if cache != nil && cache.Verified(oid) {
+		return r
+	}
+	return &verifyingDownload{
+		VerifyingReader: NewVerifyingReader(r, sha256.New(), oid, size),
+		Closer:          r,
+		done: func(err error) {
+			if err == nil {
+				if cache != nil {
+					if err := cache.MarkVerified(oid); err != nil {
+						p.logger.Log("failed to cache verification", "oid", oid, "err", err)
+					}
+				}
+				return
+			}
+			p.logger.Log("corrupt object downloaded", "oid", oid, "err", err)
+			if f, ok := p.backend.(RepairFlagger); ok {
+				if err := f.FlagForRepair(oid, err); err != nil {
+					p.logger.Log("failed to flag object for repair", "oid", oid, "err", err)
+				}
+			}
+		},
+	}
+}
+
 // Lock writes a lock to the transfer protocol.
 func (p *Processor) Lock() (Status, error) {
 	data, err := p.handler.ReadPacketListToFlush()
@@ -222,7 +363,14 @@ func (p *Processor) Lock() (Status, error) {
 	if path == "" {
 		return nil, fmt.Errorf("%w: %s", ErrMissingData, "path and refname are required")
 	}
+	p.event.Path = path
 	lockBackend := p.backend.LockBackend(args)
+	for _, policy := range p.lockPolicies {
+		if err := policy.CheckLock(lockBackend, path, refname); err != nil {
+			p.logger.Log("lock refused by policy", "path", path, "err", err)
+			return nil, err
+		}
+	}
 	retried := false
 	for {
 		lock, err := lockBackend.Create(path, refname)
@@ -240,6 +388,7 @@ func (p *Processor) Lock() (Status, error) {
 					continue
 				}
 			}
+			p.event.LockID = lock.ID()
 			return NewStatusWithArgs(StatusConflict, []string{"conflict"}, lock.AsArguments()...), nil
 		}
 		if err != nil {
@@ -247,6 +396,7 @@ func (p *Processor) Lock() (Status, error) {
 			return nil, err
 		}
 		p.logger.Log("lock success", "lock", lock)
+		p.event.LockID = lock.ID()
 		return NewStatusWithArgs(StatusCreated, nil, lock.AsArguments()...), nil
 	}
 	// unreachable
@@ -342,13 +492,22 @@ func (p *Processor) Unlock(id string) (Status, error) {
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", ErrParseError, err)
 	}
-	lock, err := p.backend.LockBackend(args).FromID(id)
+	p.event.LockID = id
+	lockBackend := p.backend.LockBackend(args)
+	lock, err := lockBackend.FromID(id)
 	if err != nil && !errors.Is(err, ErrNotFound) {
 		return nil, err
 	}
 	if lock == nil || errors.Is(err, ErrNotFound) {
 		return p.Error(StatusNotFound, fmt.Sprintf("lock %s not found", id))
 	}
+	p.event.Path = lock.Path()
+	for _, policy := range p.lockPolicies {
+		if err := policy.CheckUnlock(lockBackend, lock); err != nil {
+			p.logger.Log("unlock refused by policy", "id", id, "err", err)
+			return nil, err
+		}
+	}
 	if err := lock.Unlock(); err != nil {
 		switch {
 		case errors.Is(err, os.ErrNotExist):
@@ -388,13 +547,24 @@ func (p *Processor) ProcessCommands(op string) error {
 			continue
 		}
 		p.logger.Log("received command", "command", msgs[0], "messages", msgs[1:])
-		var status Status
+		p.event = Event{Operation: op, Command: msgs[0], Time: time.Now()}
+		status, err := p.limitRequest(msgs[0])
+		if err != nil {
+			return err
+		}
+		if status != nil {
+			if err := p.handler.SendStatus(status); err != nil {
+				p.logger.Log("failed to send pktline", "err", err)
+			}
+			p.record(status, nil)
+			continue
+		}
 		switch msgs[0] {
 		case versionCommand:
 			if len(msgs) > 0 && msgs[1] == Version {
 				status, err = p.Version()
 			} else {
-				err = p.handler.SendError(StatusBadRequest, "unknown version")
+				status = NewStatus(StatusBadRequest, "unknown version")
 			}
 		case batchCommand:
 			switch op {
@@ -405,25 +575,27 @@ func (p *Processor) ProcessCommands(op string) error {
 				p.logger.Log("download batch command received")
 				status, err = p.DownloadBatch()
 			default:
-				err = p.handler.SendError(StatusBadRequest, "unknown operation")
+				status = NewStatus(StatusBadRequest, "unknown operation")
 			}
 		case putObjectCommand:
 			if len(msgs) > 1 {
+				p.event.Oid = msgs[1]
 				status, err = p.PutObject(msgs[1])
 			} else {
-				err = p.handler.SendError(StatusBadRequest, "bad request")
+				status = NewStatus(StatusBadRequest, "bad request")
 			}
 		case verifyObjectCommand:
 			if len(msgs) > 1 {
 				status, err = p.VerifyObject(msgs[1])
 			} else {
-				err = p.handler.SendError(StatusBadRequest, "bad request")
+				status = NewStatus(StatusBadRequest, "bad request")
 			}
 		case getObjectCommand:
 			if len(msgs) > 1 {
+				p.event.Oid = msgs[1]
 				status, err = p.GetObject(msgs[1])
 			} else {
-				err = p.handler.SendError(StatusBadRequest, "bad request")
+				status = NewStatus(StatusBadRequest, "bad request")
 			}
 		case lockCommand:
 			status, err = p.Lock()
@@ -439,7 +611,7 @@ func (p *Processor) ProcessCommands(op string) error {
 			if len(msgs) > 1 {
 				status, err = p.Unlock(msgs[1])
 			} else {
-				err = p.handler.SendError(StatusBadRequest, "unknown command")
+				status = NewStatus(StatusBadRequest, "unknown command")
 			}
 		case quitCommand:
 			if err := p.handler.SendStatus(SuccessStatus()); err != nil {
@@ -447,45 +619,53 @@ func (p *Processor) ProcessCommands(op string) error {
 			}
 			return nil
 		default:
-			err = p.handler.SendError(StatusBadRequest, "unknown command")
+			status = NewStatus(StatusBadRequest, "unknown command")
 		}
 		if err != nil {
-			switch {
-			case errors.Is(err, ErrExtraData),
-				errors.Is(err, ErrParseError),
-				errors.Is(err, ErrInvalidPacket),
-				errors.Is(err, ErrCorruptData):
-				if err := p.handler.SendError(StatusBadRequest, fmt.Errorf("error: %w", err).Error()); err != nil {
-					p.logger.Log("failed to send pktline", "err", err)
-				}
-			case errors.Is(err, ErrNotAllowed):
-				if err := p.handler.SendError(StatusMethodNotAllowed, fmt.Errorf("error: %w", err).Error()); err != nil {
-					p.logger.Log("failed to send pktline", "err", err)
-				}
-			case errors.Is(err, ErrNotFound):
-				if err := p.handler.SendError(StatusNotFound, fmt.Errorf("error: %w", err).Error()); err != nil {
-					p.logger.Log("failed to send pktline", "err", err)
-				}
-			case errors.Is(err, ErrUnauthorized):
-				if err := p.handler.SendError(StatusUnauthorized, fmt.Errorf("error: %w", err).Error()); err != nil {
-					p.logger.Log("failed to send pktline", "err", err)
-				}
-			case errors.Is(err, ErrForbidden):
-				if err := p.handler.SendError(StatusForbidden, fmt.Errorf("error: %w", err).Error()); err != nil {
-					p.logger.Log("failed to send pktline", "err", err)
-				}
-			default:
-				p.logger.Log("failed to process command", "err", err)
-				if err := p.handler.SendError(StatusInternalServerError, "internal error"); err != nil {
-					p.logger.Log("failed to send pktline", "err", err)
-				}
-			}
+			status = p.errorStatus(err)
 		}
 		if status != nil {
 			if err := p.handler.SendStatus(status); err != nil {
 				p.logger.Log("failed to send pktline", "err", err)
+				if status.Reader() != nil {
+					// The data was cut short, there is no way to
+					// tell the client but to end the session.
+					p.record(status, err)
+					return err
+				}
 			}
 		}
+		p.record(status, err)
 		p.logger.Log("processed command")
 	}
 }
+
+// errorStatus returns the status answering a request that failed with err.
+func (p *Processor) errorStatus(err error) Status {
+	var code uint32
+	switch {
+	case errors.Is(err, ErrExtraData),
+		errors.Is(err, ErrParseError),
+		errors.Is(err, ErrInvalidPacket),
+		errors.Is(err, ErrCorruptData):
+		code = StatusBadRequest
+	case errors.Is(err, ErrNotAllowed):
+		code = StatusMethodNotAllowed
+	case errors.Is(err, ErrNotFound):
+		code = StatusNotFound
+	case errors.Is(err, ErrUnauthorized):
+		code = StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		code = StatusForbidden
+	case errors.Is(err, ErrTooLarge):
+		code = StatusTooLarge
+	case errors.Is(err, ErrInsufficientStorage):
+		code = StatusInsufficientStorage
+	case errors.Is(err, ErrTooManyRequests):
+		code = StatusTooManyRequests
+	default:
+		p.logger.Log("failed to process command", "err", err)
+		return NewStatus(StatusInternalServerError, "internal error")
+	}
+	return NewStatus(code, fmt.Errorf("error: %w", err).Error())
+}
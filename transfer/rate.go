@@ -0,0 +1,81 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/internal/throttle"
+)
+
+// RateLimiter limits the rate data is transferred at.
+type RateLimiter interface {
+	// Reserve takes n bytes and returns how long to wait before
+	// transferring them.
+	Reserve(n int) time.Duration
+}
+
+// RequestLimiter limits how often requests are served.
+type RequestLimiter interface {
+	// Allow takes a request for command, and returns zero if it may be
+	// served, or how long the client should wait before retrying it.
+	Allow(command string) time.Duration
+}
+
+// rateLimitedReadCloser throttles reads from a download, and closes it.
+type rateLimitedReadCloser struct {
+	*throttle.Reader
+	io.Closer
+}
+
+// limitRate throttles reads from r with the rate limiters.
+func (p *Processor) limitRate(r io.Reader) *throttle.Reader {
+	limiters := make([]throttle.Limiter, len(p.rateLimiters))
+	for i, l := range p.rateLimiters {
+		limiters[i] = l
+	}
+	return throttle.NewReader(r, limiters...)
+}
+
+// limitRequest checks a request for command against the request limiters. If
+// it's refused, the rest of the request is skipped and a status telling the
+// client when to retry is returned.
+func (p *Processor) limitRequest(command string) (Status, error) {
+	if command == versionCommand || command == quitCommand {
+		return nil, nil
+	}
+	if command == "list-locks" {
+		command = listLockCommand
+	}
+	var retry time.Duration
+	for _, l := range p.requestLimiters {
+		if d := l.Allow(command); d > retry {
+			retry = d
+		}
+	}
+	if retry == 0 {
+		return nil, nil
+	}
+	p.logger.Log("request rate limited", "command", command, "retry-after", retry)
+	if err := p.skipRequest(command); err != nil {
+		return nil, err
+	}
+	secs := int64(math.Ceil(retry.Seconds()))
+	return p.Error(StatusTooManyRequests,
+		fmt.Sprintf("error: %s: %s requests are rate limited, retry in %ds", ErrTooManyRequests, command, secs),
+		fmt.Sprintf("%s=%d", RetryAfterKey, secs))
+}
+
+// skipRequest reads the rest of a request for command without serving it.
+func (p *Processor) skipRequest(command string) error {
+	if command != putObjectCommand {
+		_, err := p.handler.ReadPacketListToFlush()
+		return err
+	}
+	if _, err := p.handler.ReadPacketListToDelim(); err != nil {
+		return err
+	}
+	_, err := io.Copy(io.Discard, p.handler.Reader())
+	return err
+}
@@ -0,0 +1,12 @@
+package transfer
+
+// Scanner scans uploaded objects before they're stored, for instance for
+// malware. Scanners return errors wrapping ErrForbidden to reject an object,
+// which is then answered with a 403 status carrying the error message. Other
+// errors fail the upload with an internal error. Backends run them once the
+// data of an object is complete and verified.
+type Scanner interface {
+	// Scan scans the object oid, whose complete contents are in the file at
+	// path.
+	Scan(oid, path string) error
+}
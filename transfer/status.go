@@ -18,6 +18,9 @@ const (
 	StatusNotFound            uint32 = http.StatusNotFound
 	StatusMethodNotAllowed    uint32 = http.StatusMethodNotAllowed
 	StatusConflict            uint32 = http.StatusConflict
+	StatusTooLarge            uint32 = http.StatusRequestEntityTooLarge
+	StatusTooManyRequests     uint32 = http.StatusTooManyRequests
+	StatusInsufficientStorage uint32 = http.StatusInsufficientStorage
 	StatusInternalServerError uint32 = http.StatusInternalServerError
 	StatusUnauthorized        uint32 = http.StatusUnauthorized
 )
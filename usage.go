@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+const usageOperation = "usage"
+
+// usage prints the storage used by the repository and its quotas.
+func usage(w io.Writer, repo *repository, args ...string) error {
+	flags := flag.NewFlagSet(usageOperation, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	recount := flags.Bool("recount", false, "recompute the usage from the stored objects")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if flags.NArg() != 0 {
+		return usageErrorf("%s: unexpected arguments: %v", usageOperation, flags.Args())
+	}
+	if kind := repo.config.String("backend", "local"); kind != "local" {
+		return fmt.Errorf("%s is not supported by the %s backend", usageOperation, kind)
+	}
+	lb, err := repo.localBackend()
+	if err != nil {
+		return err
+	}
+	var used int64
+	if *recount {
+		used, err = lb.RecountUsage()
+	} else {
+		used, err = lb.Usage()
+	}
+	if err != nil {
+		return err
+	}
+	quota, maxObject := lb.Quota()
+	fmt.Fprintf(w, "used %d\n", used)
+	fmt.Fprintf(w, "quota %d\n", quota)
+	fmt.Fprintf(w, "max-object-size %d\n", maxObject)
+	return nil
+}